@@ -0,0 +1,93 @@
+// Package anomaly flags finished encounters whose client-reported numbers
+// look implausible, so a modified client can't put itself on the leaderboards.
+// Flags are only a judgement about the numbers: flagged results are still
+// kept, just not ranked.
+package anomaly
+
+import (
+	"time"
+
+	"github.com/warhammerkid/parsec-go/leaderboard"
+	"github.com/warhammerkid/parsec-go/stats"
+)
+
+// Reasons a result can be flagged
+const (
+	// DPS or HPS far above everyone else's for the encounter
+	Outlier = "outlier"
+
+	// Cumulative totals went down partway through the encounter
+	Decreasing = "decreasing"
+
+	// Time in combat doesn't match the combat start and end times
+	Duration = "duration"
+
+	// The group did more damage than the boss has health
+	BossHealth = "boss_health"
+)
+
+const (
+	// Results needed for an encounter before outliers can be judged
+	MinSamples = 20
+
+	// Standard deviations above the mean a rate has to be to be an outlier,
+	// and how many times the mean, so tightly clustered encounters don't
+	// flag ordinary good results
+	MaxDeviations = 4
+	MaxMeanRatio  = 2
+
+	// How far time in combat can be from the combat start and end times
+	durationTolerance = 0.1
+	minDurationSlack  = 5 * time.Second
+
+	// Damage-out counts damage to everything, including adds and shields
+	// that aren't part of the boss's health, so allow some extra
+	BossHealthTolerance = 1.25
+)
+
+// Score returns the reasons a single player's result looks implausible.
+// Decreased is whether their totals went down during the encounter.
+func Score(result leaderboard.Result, history leaderboard.Distribution, decreased bool) []string {
+	var flags []string
+	dps, hps, _ := result.Rates()
+	if history.Count >= MinSamples && (outlier(dps, history.MeanDPS, history.StdDevDPS) || outlier(hps, history.MeanHPS, history.StdDevHPS)) {
+		flags = append(flags, Outlier)
+	}
+	if decreased {
+		flags = append(flags, Decreasing)
+	}
+	if inconsistentDuration(result) {
+		flags = append(flags, Duration)
+	}
+	return flags
+}
+
+// ExceedsHealth returns whether a group's combined damage for a fight is more
+// than the boss could have taken. Unknown health never exceeds.
+func ExceedsHealth(damage int64, health int64) bool {
+	return health > 0 && float64(damage) > float64(health)*BossHealthTolerance
+}
+
+func outlier(value float64, mean float64, stdDev float64) bool {
+	if value <= 0 || mean <= 0 {
+		return false
+	}
+	return value > mean*MaxMeanRatio && value > mean+stdDev*MaxDeviations
+}
+
+func inconsistentDuration(result leaderboard.Result) bool {
+	if result.CombatTicks <= 0 || result.CombatStart.IsZero() || result.CombatEnd.IsZero() {
+		return false
+	}
+	ticks := stats.TicksDuration(result.CombatTicks)
+	span := result.CombatEnd.Sub(result.CombatStart)
+	slack := time.Duration(float64(span) * durationTolerance)
+	if slack < minDurationSlack {
+		slack = minDurationSlack
+	}
+	difference := ticks - span
+	if difference < 0 {
+		difference = -difference
+	}
+	return difference > slack
+}
@@ -0,0 +1,279 @@
+// Package catalog maps the numeric RaidEncounterId and RaidEncounterMode
+// clients send to operation, boss and difficulty names, and knows how much
+// health bosses have where that's been entered. The bundled encounters.json
+// can be extended or overridden with entries saved in the database.
+package catalog
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+const (
+	selectEncounters = "SELECT id, operation, boss FROM catalog_encounters"
+	selectModes      = "SELECT id, difficulty, players FROM catalog_modes"
+	selectHealth     = "SELECT encounter_id, mode_id, health FROM catalog_health"
+	upsertEncounter  = "INSERT OR REPLACE INTO catalog_encounters VALUES (?, ?, ?)"
+	upsertMode       = "INSERT OR REPLACE INTO catalog_modes VALUES (?, ?, ?)"
+	upsertHealth     = "INSERT OR REPLACE INTO catalog_health VALUES (?, ?, ?)"
+	deleteEncounter  = "DELETE FROM catalog_encounters WHERE id=?"
+	deleteMode       = "DELETE FROM catalog_modes WHERE id=?"
+	deleteHealth     = "DELETE FROM catalog_health WHERE encounter_id=?1 OR mode_id=?2"
+)
+
+//go:embed encounters.json
+var bundled []byte
+
+type Encounter struct {
+	Id        int32  `json:"id"`
+	Operation string `json:"operation"`
+	Boss      string `json:"boss"`
+}
+
+type Mode struct {
+	Id         int32  `json:"id"`
+	Difficulty string `json:"difficulty"` // story, veteran or master
+	Players    int32  `json:"players"`
+}
+
+// Total health of a boss, including anything that has to die with it, at a
+// given difficulty
+type Health struct {
+	Encounter int32 `json:"encounter"`
+	Mode      int32 `json:"mode"`
+	Health    int64 `json:"health"`
+}
+
+// The catalog file format, also used by the admin API
+type Data struct {
+	Modes      []Mode      `json:"modes"`
+	Encounters []Encounter `json:"encounters"`
+	Health     []Health    `json:"health,omitempty"`
+}
+
+type healthKey struct {
+	encounter int32
+	mode      int32
+}
+
+// Names for an encounter, included in responses alongside the raw ids. Empty
+// if the ids aren't in the catalog.
+type Resolved struct {
+	Operation  string `json:",omitempty"`
+	Boss       string `json:",omitempty"`
+	Difficulty string `json:",omitempty"`
+	GroupSize  int32  `json:",omitempty"`
+}
+
+type Catalog struct {
+	sync.RWMutex
+	db         *sql.DB
+	bundled    Data
+	encounters map[int32]Encounter
+	modes      map[int32]Mode
+	health     map[healthKey]int64
+}
+
+// Load reads the bundled catalog and merges in any entries saved in the
+// database. The tables are created by migrations.
+func Load(db *sql.DB) (*Catalog, error) {
+	c := &Catalog{db: db}
+	err := json.Unmarshal(bundled, &c.bundled)
+	if err != nil {
+		return nil, err
+	}
+	return c, c.reload()
+}
+
+func (c *Catalog) reload() error {
+	encounters := map[int32]Encounter{}
+	modes := map[int32]Mode{}
+	health := map[healthKey]int64{}
+	for _, encounter := range c.bundled.Encounters {
+		encounters[encounter.Id] = encounter
+	}
+	for _, mode := range c.bundled.Modes {
+		modes[mode.Id] = mode
+	}
+	for _, h := range c.bundled.Health {
+		health[healthKey{h.Encounter, h.Mode}] = h.Health
+	}
+
+	// Saved entries take precedence
+	rows, err := c.db.Query(selectEncounters)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var encounter Encounter
+		err = rows.Scan(&encounter.Id, &encounter.Operation, &encounter.Boss)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		encounters[encounter.Id] = encounter
+	}
+	rows.Close()
+	rows, err = c.db.Query(selectModes)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var mode Mode
+		err = rows.Scan(&mode.Id, &mode.Difficulty, &mode.Players)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		modes[mode.Id] = mode
+	}
+	rows.Close()
+	rows, err = c.db.Query(selectHealth)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var h Health
+		err = rows.Scan(&h.Encounter, &h.Mode, &h.Health)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		health[healthKey{h.Encounter, h.Mode}] = h.Health
+	}
+	rows.Close()
+
+	c.Lock()
+	c.encounters = encounters
+	c.modes = modes
+	c.health = health
+	c.Unlock()
+	return nil
+}
+
+// Resolve looks up names for an encounter. The group size comes from the
+// mode if it defines one, otherwise from the player count the client sent.
+func (c *Catalog) Resolve(encounterId int32, modeId int32, players int32) Resolved {
+	c.RLock()
+	defer c.RUnlock()
+
+	resolved := Resolved{GroupSize: players}
+	if encounter, ok := c.encounters[encounterId]; ok {
+		resolved.Operation = encounter.Operation
+		resolved.Boss = encounter.Boss
+	}
+	if mode, ok := c.modes[modeId]; ok {
+		resolved.Difficulty = mode.Difficulty
+		if mode.Players > 0 {
+			resolved.GroupSize = mode.Players
+		}
+	}
+	return resolved
+}
+
+// Health returns a boss's total health at a difficulty, or 0 if it isn't known
+func (c *Catalog) Health(encounterId int32, modeId int32) int64 {
+	c.RLock()
+	defer c.RUnlock()
+	return c.health[healthKey{encounterId, modeId}]
+}
+
+// All returns every entry in the catalog, sorted by id
+func (c *Catalog) All() Data {
+	c.RLock()
+	defer c.RUnlock()
+
+	data := Data{
+		Modes:      make([]Mode, 0, len(c.modes)),
+		Encounters: make([]Encounter, 0, len(c.encounters)),
+	}
+	for _, mode := range c.modes {
+		data.Modes = append(data.Modes, mode)
+	}
+	for _, encounter := range c.encounters {
+		data.Encounters = append(data.Encounters, encounter)
+	}
+	for key, health := range c.health {
+		data.Health = append(data.Health, Health{Encounter: key.encounter, Mode: key.mode, Health: health})
+	}
+	sort.Slice(data.Modes, func(i, j int) bool { return data.Modes[i].Id < data.Modes[j].Id })
+	sort.Slice(data.Encounters, func(i, j int) bool { return data.Encounters[i].Id < data.Encounters[j].Id })
+	sort.Slice(data.Health, func(i, j int) bool {
+		if data.Health[i].Encounter != data.Health[j].Encounter {
+			return data.Health[i].Encounter < data.Health[j].Encounter
+		}
+		return data.Health[i].Mode < data.Health[j].Mode
+	})
+	return data
+}
+
+// Save adds or replaces entries, persisting them to the database
+func (c *Catalog) Save(data Data) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, encounter := range data.Encounters {
+		_, err = tx.Exec(upsertEncounter, encounter.Id, encounter.Operation, encounter.Boss)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, mode := range data.Modes {
+		_, err = tx.Exec(upsertMode, mode.Id, mode.Difficulty, mode.Players)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, h := range data.Health {
+		_, err = tx.Exec(upsertHealth, h.Encounter, h.Mode, h.Health)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return c.reload()
+}
+
+// Delete removes saved entries and the health saved for them, reverting to the
+// bundled ones if there are any
+func (c *Catalog) Delete(encounterIds []int32, modeIds []int32) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, id := range encounterIds {
+		_, err = tx.Exec(deleteEncounter, id)
+		if err == nil {
+			_, err = tx.Exec(deleteHealth, id, nil)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, id := range modeIds {
+		_, err = tx.Exec(deleteMode, id)
+		if err == nil {
+			_, err = tx.Exec(deleteHealth, nil, id)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return c.reload()
+}
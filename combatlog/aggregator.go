@@ -0,0 +1,245 @@
+package combatlog
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/warhammerkid/parsec-go/stats"
+)
+
+// Longest line the aggregator will hold on to while waiting for the rest of it.
+// Real log lines are a few hundred bytes, so anything longer is garbage.
+const MaxLineLength = 4096
+
+// Totals for the current (or most recent) combat, from the log owner's point
+// of view
+type Totals struct {
+	DamageOut        int64
+	DamageIn         int64
+	HealOut          int64
+	EffectiveHealOut int64
+	HealIn           int64
+	Threat           int64
+	CombatStart      time.Time
+	CombatEnd        time.Time
+	CombatTicks      int64 // 100ns ticks, to match what clients send
+}
+
+// Aggregator totals up a single player's combat log as it's appended to
+type Aggregator struct {
+	sync.Mutex
+	owner    string
+	day      time.Time
+	lastTime time.Duration
+	started  bool
+	inCombat bool
+	pending  []byte // Partial line left over from the last write
+	overlong bool   // Whether the rest of an overlong line is being dropped
+	totals   Totals
+
+	// Per-ability numbers for the current combat, keyed by ability id
+	damageOut map[int64]*stats.AbilityStats
+	healOut   map[int64]*stats.AbilityStats
+	damageIn  map[int64]*stats.AbilityStats
+}
+
+// NewAggregator creates an aggregator for the log of the given character,
+// with times resolved relative to the given date. If owner is empty, it is
+// taken from the first line the player is the source of.
+func NewAggregator(owner string, date time.Time) *Aggregator {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	a := &Aggregator{owner: owner, day: day}
+	a.resetAbilities()
+	return a
+}
+
+// Write appends a batch of log lines, returning how many lines were parsed
+// and how many were skipped as malformed. A trailing partial line is held
+// until the next write, unless it's longer than MaxLineLength, in which case
+// it's skipped.
+func (a *Aggregator) Write(batch []byte) (int, int) {
+	a.Lock()
+	defer a.Unlock()
+
+	parsed := 0
+	skipped := 0
+
+	// Drop the rest of a line that was already too long
+	if a.overlong {
+		start := bytes.IndexByte(batch, '\n')
+		if start < 0 {
+			return 0, 0
+		}
+		batch = batch[start+1:]
+		a.overlong = false
+	}
+
+	data := append(a.pending, batch...)
+	end := bytes.LastIndexByte(data, '\n')
+	if len(data)-end-1 > MaxLineLength {
+		a.pending = nil
+		a.overlong = true
+		skipped++
+	} else {
+		a.pending = append([]byte(nil), data[end+1:]...)
+	}
+	if end < 0 {
+		return parsed, skipped
+	}
+
+	for _, raw := range strings.Split(string(data[:end]), "\n") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		line, err := ParseLine(raw)
+		if err != nil {
+			skipped++
+			continue
+		}
+		a.add(line)
+		parsed++
+	}
+	return parsed, skipped
+}
+
+// Totals returns the totals for the current or most recent combat
+func (a *Aggregator) Totals() Totals {
+	a.Lock()
+	defer a.Unlock()
+	return a.totals
+}
+
+// Abilities returns the per-ability breakdown for the current or most recent
+// combat
+func (a *Aggregator) Abilities() stats.AbilityBreakdown {
+	a.Lock()
+	defer a.Unlock()
+	var b stats.AbilityBreakdown
+	b.Merge(&stats.AbilityBreakdown{
+		DamageOut: abilityList(a.damageOut),
+		HealOut:   abilityList(a.healOut),
+		DamageIn:  abilityList(a.damageIn),
+	})
+	return b
+}
+
+// Owner returns the name of the character whose log this is
+func (a *Aggregator) Owner() string {
+	a.Lock()
+	defer a.Unlock()
+	return a.owner
+}
+
+func (a *Aggregator) add(line Line) {
+	// Resolve time of day, rolling over at midnight
+	if a.started && line.Time < a.lastTime-12*time.Hour {
+		a.day = a.day.AddDate(0, 0, 1)
+	}
+	a.started = true
+	a.lastTime = line.Time
+	now := a.day.Add(line.Time)
+
+	if a.owner == "" && line.Source.Player && line.Source.Companion == "" {
+		a.owner = line.Source.Name
+	}
+	fromOwner := a.isOwner(line.Source)
+	toOwner := a.isOwner(line.Target)
+
+	// Combat boundaries
+	switch line.Effect.Name {
+	case EnterCombat:
+		if fromOwner {
+			a.totals = Totals{CombatStart: now}
+			a.resetAbilities()
+			a.inCombat = true
+		}
+		return
+	case ExitCombat:
+		if fromOwner {
+			a.totals.CombatEnd = now
+			a.updateTicks(now)
+			a.inCombat = false
+		}
+		return
+	}
+
+	// Damage and healing
+	if line.Event.Name == ApplyEffect {
+		switch line.Effect.Name {
+		case Damage:
+			if fromOwner {
+				a.totals.DamageOut += line.Value.Amount
+				addAbility(a.damageOut, line.Ability, line.Value.Amount, line.Value.Critical)
+			}
+			if toOwner {
+				a.totals.DamageIn += line.Value.Amount
+				addAbility(a.damageIn, line.Ability, line.Value.Amount, line.Value.Critical)
+			}
+		case Heal:
+			effective := line.Value.Effective
+			if effective < 0 {
+				effective = line.Value.Amount
+			}
+			if fromOwner {
+				a.totals.HealOut += line.Value.Amount
+				a.totals.EffectiveHealOut += effective
+				addAbility(a.healOut, line.Ability, line.Value.Amount, line.Value.Critical)
+			}
+			if toOwner {
+				a.totals.HealIn += line.Value.Amount
+			}
+		}
+	}
+
+	// Threat
+	if fromOwner && line.HasThreat {
+		a.totals.Threat += line.Threat
+	}
+
+	if a.inCombat {
+		a.updateTicks(now)
+	}
+}
+
+func (a *Aggregator) updateTicks(now time.Time) {
+	if !a.totals.CombatStart.IsZero() {
+		a.totals.CombatTicks = int64(now.Sub(a.totals.CombatStart) / 100)
+	}
+}
+
+func (a *Aggregator) resetAbilities() {
+	a.damageOut = map[int64]*stats.AbilityStats{}
+	a.healOut = map[int64]*stats.AbilityStats{}
+	a.damageIn = map[int64]*stats.AbilityStats{}
+}
+
+func addAbility(abilities map[int64]*stats.AbilityStats, ability Named, amount int64, critical bool) {
+	entry := abilities[ability.Id]
+	if entry == nil {
+		entry = &stats.AbilityStats{AbilityId: ability.Id, AbilityName: ability.Name}
+		abilities[ability.Id] = entry
+	}
+	entry.Hits++
+	if critical {
+		entry.Crits++
+	}
+	entry.Total += amount
+	if amount > entry.Max {
+		entry.Max = amount
+	}
+}
+
+func abilityList(abilities map[int64]*stats.AbilityStats) []stats.AbilityStats {
+	list := make([]stats.AbilityStats, 0, len(abilities))
+	for _, ability := range abilities {
+		list = append(list, *ability)
+	}
+	return list
+}
+
+func (a *Aggregator) isOwner(entity Entity) bool {
+	return entity.Player && entity.Companion == "" && entity.Name == a.owner
+}
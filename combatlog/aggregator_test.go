@@ -0,0 +1,114 @@
+package combatlog
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var testLog = []string{
+	"[23:59:58.000] [@Karmeld] [] [] [Event {836045448945472}: EnterCombat {836045489549315}]",
+	"[23:59:59.000] [@Karmeld] [Dread Master Bestia {3273941900591104}] [Force Lightning {808226395062272}] [ApplyEffect {836045448945477}: Damage {836045448945501}] (1000* energy {836045448940874}) <1000>",
+	"[00:00:00.500] [Dread Master Bestia {3273941900591104}] [@Karmeld] [Swipe {3294265458688000}] [ApplyEffect {836045448945477}: Damage {836045448945501}] (400 kinetic {836045448940873}) <400>",
+	"[00:00:01.000] [@Karmeld] [=] [Resurgence {814502817202176}] [ApplyEffect {836045448945477}: Heal {836045448945500}] (600 ~350) <300>",
+	"[00:00:01.500] [@Healer] [@Karmeld] [Kolto Probe {814832019374080}] [ApplyEffect {836045448945477}: Heal {836045448945500}] (200) <100>",
+	"[00:00:02.000] [@Karmeld] [] [] [Event {836045448945472}: ExitCombat {836045489549316}]",
+}
+
+func TestAggregatorTotals(t *testing.T) {
+	a := NewAggregator("", time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC))
+	parsed, skipped := a.Write([]byte(strings.Join(testLog, "\n") + "\n"))
+	if parsed != len(testLog) || skipped != 0 {
+		t.Fatalf("Write = %d, %d, want %d, 0", parsed, skipped, len(testLog))
+	}
+	if a.Owner() != "Karmeld" {
+		t.Errorf("Owner = %q, want Karmeld", a.Owner())
+	}
+
+	totals := a.Totals()
+	want := Totals{
+		DamageOut:        1000,
+		DamageIn:         400,
+		HealOut:          600,
+		EffectiveHealOut: 350,
+		HealIn:           800,
+		Threat:           1300,
+		CombatStart:      time.Date(2024, 3, 9, 23, 59, 58, 0, time.UTC),
+		CombatEnd:        time.Date(2024, 3, 10, 0, 0, 2, 0, time.UTC),
+		CombatTicks:      int64(4 * time.Second / 100),
+	}
+	if !totals.CombatStart.Equal(want.CombatStart) || !totals.CombatEnd.Equal(want.CombatEnd) {
+		t.Errorf("Combat = %v to %v, want %v to %v", totals.CombatStart, totals.CombatEnd, want.CombatStart, want.CombatEnd)
+	}
+	totals.CombatStart, totals.CombatEnd = want.CombatStart, want.CombatEnd
+	if totals != want {
+		t.Errorf("Totals = %+v, want %+v", totals, want)
+	}
+}
+
+func TestAggregatorTimeZone(t *testing.T) {
+	// Log times are the player's local time
+	zone := time.FixedZone("", -5*60*60)
+	a := NewAggregator("Karmeld", time.Date(2024, 3, 9, 0, 0, 0, 0, zone))
+	a.Write([]byte(testLog[0] + "\n"))
+	want := time.Date(2024, 3, 10, 4, 59, 58, 0, time.UTC)
+	if start := a.Totals().CombatStart; !start.Equal(want) {
+		t.Errorf("CombatStart = %v, want %v", start, want)
+	}
+}
+
+func TestAggregatorPartialLines(t *testing.T) {
+	a := NewAggregator("Karmeld", time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC))
+	data := testLog[0] + "\n" + testLog[1] + "\n"
+	split := len(testLog[0]) + 20
+
+	parsed, skipped := a.Write([]byte(data[:split]))
+	if parsed != 1 || skipped != 0 {
+		t.Errorf("first Write = %d, %d, want 1, 0", parsed, skipped)
+	}
+	if damage := a.Totals().DamageOut; damage != 0 {
+		t.Errorf("DamageOut from a partial line = %d, want 0", damage)
+	}
+
+	parsed, skipped = a.Write([]byte(data[split:]))
+	if parsed != 1 || skipped != 0 {
+		t.Errorf("second Write = %d, %d, want 1, 0", parsed, skipped)
+	}
+	if damage := a.Totals().DamageOut; damage != 1000 {
+		t.Errorf("DamageOut = %d, want 1000", damage)
+	}
+}
+
+func TestAggregatorMalformed(t *testing.T) {
+	a := NewAggregator("Karmeld", time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC))
+	parsed, skipped := a.Write([]byte(testLog[0] + "\nnot a log line\n\n[12:00] [@Karmeld]\n" + testLog[1] + "\n"))
+	if parsed != 2 || skipped != 2 {
+		t.Errorf("Write = %d, %d, want 2, 2", parsed, skipped)
+	}
+	if damage := a.Totals().DamageOut; damage != 1000 {
+		t.Errorf("DamageOut = %d, want 1000", damage)
+	}
+}
+
+func TestAggregatorOverlongLine(t *testing.T) {
+	a := NewAggregator("Karmeld", time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC))
+	long := strings.Repeat("x", MaxLineLength+1)
+
+	// The overlong line is skipped once, and the rest of it dropped until the
+	// next newline
+	parsed, skipped := a.Write([]byte(testLog[0] + "\n" + long))
+	if parsed != 1 || skipped != 1 {
+		t.Errorf("first Write = %d, %d, want 1, 1", parsed, skipped)
+	}
+	parsed, skipped = a.Write([]byte(long))
+	if parsed != 0 || skipped != 0 {
+		t.Errorf("second Write = %d, %d, want 0, 0", parsed, skipped)
+	}
+	parsed, skipped = a.Write([]byte("more\n" + testLog[1] + "\n"))
+	if parsed != 1 || skipped != 0 {
+		t.Errorf("third Write = %d, %d, want 1, 0", parsed, skipped)
+	}
+	if damage := a.Totals().DamageOut; damage != 1000 {
+		t.Errorf("DamageOut = %d, want 1000", damage)
+	}
+}
@@ -0,0 +1,234 @@
+// Package combatlog parses SWTOR combat log lines and totals them up into the
+// same stats Parsec clients report.
+//
+// A line looks like:
+//
+//	[22:14:31.226] [@Karmeld] [Dread Master Bestia {3273941900591104}] [Force Lightning {808226395062272}] [ApplyEffect {836045448945477}: Damage {836045448945501}] (1234* energy {836045448940874}) <1234>
+//
+// with the timestamp, source, target, ability, event and effect, value and
+// threat. Entities from the newer log format, which carry ids, positions and
+// health separated by '|', are reduced to their names.
+package combatlog
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Effect and event names the aggregator cares about
+const (
+	ApplyEffect = "ApplyEffect"
+	Damage      = "Damage"
+	Heal        = "Heal"
+	EnterCombat = "EnterCombat"
+	ExitCombat  = "ExitCombat"
+)
+
+var ErrMalformedLine = errors.New("Malformed combat log line")
+
+// A game object reference with its name and numeric id, like
+// "Force Lightning {808226395062272}"
+type Named struct {
+	Name string
+	Id   int64
+}
+
+type Entity struct {
+	Name      string // Player name without the leading '@', or NPC name
+	Id        int64  // Only set for NPCs
+	Player    bool
+	Companion string // Companion name if this is a player's companion
+}
+
+type Value struct {
+	Amount    int64
+	Critical  bool
+	Effective int64 // Effective healing, or -1 if not reported
+	Type      Named // Damage type, e.g. energy or kinetic
+	Absorbed  int64
+}
+
+type Line struct {
+	Time      time.Duration // Time of day
+	Source    Entity
+	Target    Entity
+	Ability   Named
+	Event     Named
+	Effect    Named
+	Value     Value
+	Threat    int64
+	HasThreat bool
+}
+
+// ParseLine parses a single combat log line
+func ParseLine(raw string) (Line, error) {
+	var line Line
+	rest := strings.TrimSpace(raw)
+
+	// Bracketed fields
+	fields := make([]string, 5)
+	for i := range fields {
+		field, remaining, ok := cutDelimited(rest, '[', ']')
+		if !ok {
+			return line, ErrMalformedLine
+		}
+		fields[i] = field
+		rest = remaining
+	}
+
+	var err error
+	line.Time, err = parseTimeOfDay(fields[0])
+	if err != nil {
+		return line, ErrMalformedLine
+	}
+	line.Source = parseEntity(fields[1])
+	if strings.TrimSpace(fields[2]) == "=" {
+		line.Target = line.Source
+	} else {
+		line.Target = parseEntity(fields[2])
+	}
+	line.Ability = parseNamed(fields[3])
+	event, effect, _ := strings.Cut(fields[4], ": ")
+	line.Event = parseNamed(event)
+	line.Effect = parseNamed(effect)
+
+	// Value
+	line.Value.Effective = -1
+	if field, remaining, ok := cutDelimited(rest, '(', ')'); ok {
+		line.Value = parseValue(field)
+		rest = remaining
+	}
+
+	// Threat
+	if field, _, ok := cutDelimited(rest, '<', '>'); ok {
+		threat, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+		if err == nil {
+			line.Threat = threat
+			line.HasThreat = true
+		}
+	}
+
+	return line, nil
+}
+
+// Splits "[a [b]] rest" into "a [b]" and "rest", allowing for nesting
+func cutDelimited(s string, open byte, close byte) (string, string, bool) {
+	s = strings.TrimLeft(s, " ")
+	if len(s) == 0 || s[0] != open {
+		return "", s, false
+	}
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return s[1:i], s[i+1:], true
+			}
+		}
+	}
+	return "", s, false
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04:05.000", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond()), nil
+}
+
+func parseNamed(s string) Named {
+	s = strings.TrimSpace(s)
+	open := strings.LastIndex(s, " {")
+	if open < 0 || !strings.HasSuffix(s, "}") {
+		return Named{Name: s}
+	}
+	id, _ := strconv.ParseInt(s[open+2:len(s)-1], 10, 64)
+	return Named{Name: s[:open], Id: id}
+}
+
+func parseEntity(s string) Entity {
+	// Newer logs append position and health after the name
+	s, _, _ = strings.Cut(strings.TrimSpace(s), "|")
+	if s == "" {
+		return Entity{}
+	}
+
+	// NPCs, with an optional instance id in newer logs
+	if s[0] != '@' {
+		if end := strings.LastIndex(s, "}"); end >= 0 {
+			s = s[:end+1]
+		}
+		named := parseNamed(s)
+		return Entity{Name: named.Name, Id: named.Id}
+	}
+
+	// Players, optionally followed by a companion as "@Name:Companion {id}" or
+	// "@Name#id/Companion {id}:instance" in newer logs
+	entity := Entity{Player: true}
+	s = s[1:]
+	sep := strings.IndexAny(s, ":/")
+	if sep >= 0 {
+		companion := s[sep+1:]
+		if end := strings.LastIndex(companion, "}"); end >= 0 {
+			companion = companion[:end+1]
+		}
+		entity.Companion = parseNamed(companion).Name
+		s = s[:sep]
+	}
+	entity.Name, _, _ = strings.Cut(s, "#")
+	return entity
+}
+
+// Parses values like "1234* energy {id} -shield {id} (500 absorbed {id})" or
+// "2500* ~1800"
+func parseValue(s string) Value {
+	value := Value{Effective: -1}
+
+	// Pull out absorbed amount
+	if i := strings.IndexByte(s, '('); i >= 0 {
+		if absorbed, _, ok := cutDelimited(s[i:], '(', ')'); ok {
+			amount, _, _ := strings.Cut(strings.TrimSpace(absorbed), " ")
+			value.Absorbed, _ = strconv.ParseInt(amount, 10, 64)
+		}
+		s = s[:i]
+	}
+
+	parts := strings.Fields(s)
+	if len(parts) == 0 {
+		return value
+	}
+
+	// Amount and crit marker
+	amount := parts[0]
+	if strings.HasSuffix(amount, "*") {
+		value.Critical = true
+		amount = amount[:len(amount)-1]
+	}
+	value.Amount, _ = strconv.ParseInt(amount, 10, 64)
+	parts = parts[1:]
+
+	// Effective healing
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "~") {
+		value.Effective, _ = strconv.ParseInt(parts[0][1:], 10, 64)
+		parts = parts[1:]
+	}
+
+	// Damage type, up to any mitigation like "-shield {id}"
+	typeParts := make([]string, 0, 2)
+	for _, part := range parts {
+		if strings.HasPrefix(part, "-") {
+			break
+		}
+		typeParts = append(typeParts, part)
+	}
+	value.Type = parseNamed(strings.Join(typeParts, " "))
+
+	return value
+}
@@ -0,0 +1,161 @@
+package combatlog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want Line
+	}{
+		{
+			"damage",
+			"[22:14:31.226] [@Karmeld] [Dread Master Bestia {3273941900591104}] [Force Lightning {808226395062272}] [ApplyEffect {836045448945477}: Damage {836045448945501}] (1234* energy {836045448940874}) <1234>",
+			Line{
+				Time:      22*time.Hour + 14*time.Minute + 31*time.Second + 226*time.Millisecond,
+				Source:    Entity{Name: "Karmeld", Player: true},
+				Target:    Entity{Name: "Dread Master Bestia", Id: 3273941900591104},
+				Ability:   Named{"Force Lightning", 808226395062272},
+				Event:     Named{ApplyEffect, 836045448945477},
+				Effect:    Named{Damage, 836045448945501},
+				Value:     Value{Amount: 1234, Critical: true, Effective: -1, Type: Named{"energy", 836045448940874}},
+				Threat:    1234,
+				HasThreat: true,
+			},
+		},
+		{
+			"mitigated damage",
+			"[22:14:32.001] [Dread Master Bestia {3273941900591104}] [@Karmeld] [Swipe {3294265458688000}] [ApplyEffect {836045448945477}: Damage {836045448945501}] (800 kinetic {836045448940873} -shield {836045448945509} (300 absorbed {836045448945511})) <800>",
+			Line{
+				Time:      22*time.Hour + 14*time.Minute + 32*time.Second + time.Millisecond,
+				Source:    Entity{Name: "Dread Master Bestia", Id: 3273941900591104},
+				Target:    Entity{Name: "Karmeld", Player: true},
+				Ability:   Named{"Swipe", 3294265458688000},
+				Event:     Named{ApplyEffect, 836045448945477},
+				Effect:    Named{Damage, 836045448945501},
+				Value:     Value{Amount: 800, Effective: -1, Type: Named{"kinetic", 836045448940873}, Absorbed: 300},
+				Threat:    800,
+				HasThreat: true,
+			},
+		},
+		{
+			"heal on self",
+			"[22:15:00.500] [@Karmeld] [=] [Resurgence {814502817202176}] [ApplyEffect {836045448945477}: Heal {836045448945500}] (2500* ~1800) <900>",
+			Line{
+				Time:      22*time.Hour + 15*time.Minute + 500*time.Millisecond,
+				Source:    Entity{Name: "Karmeld", Player: true},
+				Target:    Entity{Name: "Karmeld", Player: true},
+				Ability:   Named{"Resurgence", 814502817202176},
+				Event:     Named{ApplyEffect, 836045448945477},
+				Effect:    Named{Heal, 836045448945500},
+				Value:     Value{Amount: 2500, Critical: true, Effective: 1800},
+				Threat:    900,
+				HasThreat: true,
+			},
+		},
+		{
+			"threat only",
+			"[22:15:01.000] [@Karmeld] [Dread Master Bestia {3273941900591104}] [Taunt {810863567347712}] [Event {836045448945472}: AbilityActivate {836045448945479}] <5000>",
+			Line{
+				Time:      22*time.Hour + 15*time.Minute + time.Second,
+				Source:    Entity{Name: "Karmeld", Player: true},
+				Target:    Entity{Name: "Dread Master Bestia", Id: 3273941900591104},
+				Ability:   Named{"Taunt", 810863567347712},
+				Event:     Named{"Event", 836045448945472},
+				Effect:    Named{"AbilityActivate", 836045448945479},
+				Value:     Value{Effective: -1},
+				Threat:    5000,
+				HasThreat: true,
+			},
+		},
+		{
+			"enter combat",
+			"[22:14:30.000] [@Karmeld] [] [] [Event {836045448945472}: EnterCombat {836045489549315}]",
+			Line{
+				Time:   22*time.Hour + 14*time.Minute + 30*time.Second,
+				Source: Entity{Name: "Karmeld", Player: true},
+				Event:  Named{"Event", 836045448945472},
+				Effect: Named{EnterCombat, 836045489549315},
+				Value:  Value{Effective: -1},
+			},
+		},
+		{
+			"companion",
+			"[22:14:33.000] [@Karmeld:Lord Scourge {493302363914240}] [Dread Master Bestia {3273941900591104}] [Ravage {807711039012864}] [ApplyEffect {836045448945477}: Damage {836045448945501}] (500 kinetic {836045448940873})",
+			Line{
+				Time:    22*time.Hour + 14*time.Minute + 33*time.Second,
+				Source:  Entity{Name: "Karmeld", Player: true, Companion: "Lord Scourge"},
+				Target:  Entity{Name: "Dread Master Bestia", Id: 3273941900591104},
+				Ability: Named{"Ravage", 807711039012864},
+				Event:   Named{ApplyEffect, 836045448945477},
+				Effect:  Named{Damage, 836045448945501},
+				Value:   Value{Amount: 500, Effective: -1, Type: Named{"kinetic", 836045448940873}},
+			},
+		},
+		{
+			"newer format entities",
+			"[22:14:34.000] [@Karmeld#689203382607868|(4.72,-3.04,-0.52,84.00)|(390000/390000)] [Dread Master Bestia {3273941900591104}:5320000133467|(0.00,0.00,0.00,0.00)|(1/9000000)] [Force Lightning {808226395062272}] [ApplyEffect {836045448945477}: Damage {836045448945501}] (1000 energy {836045448940874}) <1000>",
+			Line{
+				Time:      22*time.Hour + 14*time.Minute + 34*time.Second,
+				Source:    Entity{Name: "Karmeld", Player: true},
+				Target:    Entity{Name: "Dread Master Bestia", Id: 3273941900591104},
+				Ability:   Named{"Force Lightning", 808226395062272},
+				Event:     Named{ApplyEffect, 836045448945477},
+				Effect:    Named{Damage, 836045448945501},
+				Value:     Value{Amount: 1000, Effective: -1, Type: Named{"energy", 836045448940874}},
+				Threat:    1000,
+				HasThreat: true,
+			},
+		},
+	}
+	for _, test := range tests {
+		got, err := ParseLine(test.raw)
+		if err != nil {
+			t.Errorf("%s: ParseLine returned %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: ParseLine = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseLineMalformed(t *testing.T) {
+	tests := []string{
+		"",
+		"garbage",
+		"[22:14:31.226] [@Karmeld] [Dread Master Bestia {3273941900591104}]",
+		"[22:14:31.226] [@Karmeld] [Dread Master Bestia {3273941900591104}] [Force Lightning {808226395062272}] [ApplyEffect {836045448945477}: Damage",
+		"[not a time] [@Karmeld] [=] [Force Lightning {808226395062272}] [ApplyEffect {836045448945477}: Damage {836045448945501}] (1234)",
+		"[25:00:00.000] [@Karmeld] [=] [Force Lightning {808226395062272}] [ApplyEffect {836045448945477}: Damage {836045448945501}] (1234)",
+	}
+	for _, raw := range tests {
+		if _, err := ParseLine(raw); err != ErrMalformedLine {
+			t.Errorf("ParseLine(%q) error = %v, want %v", raw, err, ErrMalformedLine)
+		}
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Value
+	}{
+		{"0", Value{Effective: -1}},
+		{"1234", Value{Amount: 1234, Effective: -1}},
+		{"1234*", Value{Amount: 1234, Critical: true, Effective: -1}},
+		{"2500 ~0", Value{Amount: 2500, Effective: 0}},
+		{"500 internal {836045448940876}", Value{Amount: 500, Effective: -1, Type: Named{"internal", 836045448940876}}},
+		{"0 -immune {836045448945506}", Value{Effective: -1}},
+		{"900 energy {836045448940874} (900 absorbed {836045448945511})", Value{Amount: 900, Effective: -1, Type: Named{"energy", 836045448940874}, Absorbed: 900}},
+	}
+	for _, test := range tests {
+		if got := parseValue(test.value); got != test.want {
+			t.Errorf("parseValue(%q) = %+v, want %+v", test.value, got, test.want)
+		}
+	}
+}
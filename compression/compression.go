@@ -0,0 +1,201 @@
+// Package compression handles Accept-Encoding negotiation and compression of
+// API responses, as well as decoding of compressed request bodies.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	Identity = "identity"
+	Gzip     = "gzip"
+	Deflate  = "deflate"
+	Brotli   = "br"
+	Zstd     = "zstd"
+
+	// Returned when the client refuses identity and accepts nothing we
+	// support, so the response has to be a 406
+	NotAcceptable = ""
+
+	// Payloads smaller than this are sent uncompressed, as the encoding
+	// overhead outweighs any savings
+	MinSize = 512
+)
+
+var (
+	// Encodings in server preference order, used to break ties between
+	// encodings the client weights equally
+	Preferred = []string{Zstd, Brotli, Gzip, Deflate}
+
+	ErrUnsupportedEncoding = errors.New("Unsupported Content-Encoding")
+
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+)
+
+// Negotiate picks the best encoding from an Accept-Encoding header value,
+// returning Identity if nothing else is acceptable, or NotAcceptable if
+// identity has been refused too
+func Negotiate(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return Identity
+	}
+	weights := parseWeights(acceptEncoding)
+
+	// Pick the highest weighted encoding we support
+	best := Identity
+	bestQ := 0.0
+	for _, encoding := range Preferred {
+		q, ok := weights[encoding]
+		if !ok {
+			q, ok = weights["*"]
+		}
+		if ok && q > bestQ {
+			best = encoding
+			bestQ = q
+		}
+	}
+	if best == Identity && !identityAcceptable(weights) {
+		return NotAcceptable
+	}
+	return best
+}
+
+// Choose picks the encoding for a response of the given size. Small responses
+// are only compressed if the client refuses identity.
+func Choose(acceptEncoding string, size int) string {
+	if size < MinSize && identityAcceptable(parseWeights(acceptEncoding)) {
+		return Identity
+	}
+	return Negotiate(acceptEncoding)
+}
+
+// Key returns what an Accept-Encoding header value means for the encoding of
+// a response, so responses cached by it aren't split between equivalent
+// headers
+func Key(acceptEncoding string) string {
+	return Choose(acceptEncoding, 0) + "," + Negotiate(acceptEncoding)
+}
+
+// Parses out the quality value of each encoding
+func parseWeights(acceptEncoding string) map[string]float64 {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+		weights[name] = q
+	}
+	return weights
+}
+
+// Identity is acceptable unless it's refused by name, or by "*" when it isn't
+// named
+func identityAcceptable(weights map[string]float64) bool {
+	q, ok := weights[Identity]
+	if !ok {
+		q, ok = weights["*"]
+	}
+	return !ok || q > 0
+}
+
+// Encode compresses data with the given encoding
+func Encode(encoding string, data []byte) ([]byte, error) {
+	if encoding == Zstd {
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	}
+
+	var buf bytes.Buffer
+	var cw io.WriteCloser
+	switch encoding {
+	case Identity:
+		return data, nil
+	case Gzip:
+		cw, _ = gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	case Deflate:
+		cw, _ = zlib.NewWriterLevel(&buf, zlib.BestSpeed)
+	case Brotli:
+		cw = brotli.NewWriterLevel(&buf, brotli.BestSpeed)
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+	if _, err := cw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Write sends body to the client, compressed with whatever encoding the
+// request accepts if it's large enough to be worth it
+func Write(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	encoding := Choose(r.Header.Get("Accept-Encoding"), len(body))
+	if encoding != Identity && encoding != NotAcceptable {
+		compressed, err := Encode(encoding, body)
+		if err == nil {
+			body = compressed
+		} else {
+			encoding = Identity
+		}
+	}
+	WriteEncoded(w, contentType, encoding, body)
+}
+
+// WriteEncoded sends a body that has already been compressed with encoding
+func WriteEncoded(w http.ResponseWriter, contentType string, encoding string, body []byte) {
+	if encoding == NotAcceptable {
+		w.Header().Add("Vary", "Accept-Encoding")
+		http.Error(w, "No acceptable Content-Encoding", http.StatusNotAcceptable)
+		return
+	}
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Add("Vary", "Accept-Encoding")
+	if encoding != Identity {
+		header.Set("Content-Encoding", encoding)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// DecodeRequestBody replaces the request body with a decompressing reader if
+// the client sent a compressed body
+func DecodeRequestBody(r *http.Request) error {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", Identity:
+		return nil
+	case Gzip:
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = gz
+		r.Header.Del("Content-Encoding")
+		return nil
+	default:
+		return ErrUnsupportedEncoding
+	}
+}
@@ -0,0 +1,40 @@
+// Package dashboard is the web UI parsec2 serves at its root. Raid members
+// log in with their group name and password to watch everyone's meters update
+// live and look back over the group's finished encounters. The assets are
+// embedded, so the binary serves them without any files alongside it.
+//
+// The dashboard only uses the public v2 API: it connects as a spectator,
+// long-polls stats, and reads finished encounters from the export.
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the dashboard's assets
+func Handler() http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.FileServer(http.FS(files))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Unsupported method", 404)
+			return
+		}
+
+		// Embedded files have no modification time, so make browsers check
+		// for new assets after an upgrade. The page takes a password, so it
+		// can't be framed or load anything from elsewhere either.
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		fileServer.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,441 @@
+// Parsec dashboard. Logs in to the raid group as a spectator, so watching
+// doesn't add anyone to the group, then long-polls the group's stats and
+// draws them as meters. Finished encounters come from the group's export.
+(function() {
+  'use strict';
+
+  var METRICS = {
+    damage: {field: 'DamageOut', name: 'Damage'},
+    healing: {field: 'HealOut', name: 'Healing'},
+    threat: {field: 'Threat', name: 'Threat'},
+    taken: {field: 'DamageIn', name: 'Damage taken'}
+  };
+
+  var POLL_WAIT = 30; // Seconds each long-poll waits for the group to change
+  var RETRY_DELAY = 5000;
+  var HISTORY_DAYS = 14; // How far back finished encounters are listed
+  var HISTORY_REFRESH = 60000;
+
+  // Members' combat starts for the same fight are this close, like the
+  // server's leaderboard.FightWindow
+  var FIGHT_WINDOW = 30000;
+
+  var state = {
+    name: '',
+    password: '',
+    token: '',
+    session: 0, // Changed on logout, so requests from before are ignored
+    version: 0,
+    live: [], // Latest stats for each member
+    fights: [], // Finished fights, newest first
+    selected: 'live',
+    metric: 'damage',
+    sort: 'total',
+    encounters: {},
+    modes: {}
+  };
+
+  var $ = function(id) { return document.getElementById(id); };
+
+  function init() {
+    var form = $('login');
+    form.elements.name.value = localStorage.getItem('parsec.group') || '';
+    form.addEventListener('submit', function(e) {
+      e.preventDefault();
+      login(form.elements.name.value.trim(), form.elements.password.value);
+    });
+    $('logout').addEventListener('click', logout);
+    $('encounter').addEventListener('change', function(e) {
+      state.selected = e.target.value;
+      render();
+    });
+    $('sort').addEventListener('change', function(e) {
+      state.sort = e.target.value;
+      render();
+    });
+    $('metrics').addEventListener('click', function(e) {
+      var metric = e.target.getAttribute('data-metric');
+      if (!metric) {
+        return;
+      }
+      state.metric = metric;
+      var buttons = $('metrics').querySelectorAll('button');
+      for (var i = 0; i < buttons.length; i++) {
+        buttons[i].setAttribute('aria-pressed', String(buttons[i] === e.target));
+      }
+      render();
+    });
+
+    // Rates for members still in combat grow between updates
+    setInterval(function() {
+      if (state.token && state.selected === 'live') {
+        render();
+      }
+    }, 1000);
+
+    show(false);
+  }
+
+  function show(loggedIn) {
+    $('login').hidden = loggedIn;
+    $('dashboard').hidden = !loggedIn;
+    if (!loggedIn) {
+      $('login').elements.password.focus();
+    }
+  }
+
+  function login(name, password) {
+    $('login-error').textContent = '';
+    state.name = name;
+    state.password = password;
+    state.session++;
+    var session = state.session;
+    connect().then(function() {
+      if (session !== state.session) {
+        return;
+      }
+      localStorage.setItem('parsec.group', name);
+      $('group-name').textContent = name;
+      $('login').elements.password.value = '';
+      show(true);
+      loadCatalog();
+      poll(session);
+      loadHistory(session);
+    }, function(err) {
+      $('login-error').textContent = err.message;
+    });
+  }
+
+  function logout() {
+    state.session++;
+    state.token = '';
+    state.password = '';
+    state.version = 0;
+    state.live = [];
+    state.fights = [];
+    state.selected = 'live';
+    renderEncounters();
+    show(false);
+  }
+
+  // Gets a new connection token, which is also how expired ones are replaced
+  function connect() {
+    var url = '/api/v2/connect?' + query({name: state.name, password: state.password, spectator: 'true'});
+    return fetch(url, {method: 'POST'}).then(function(res) {
+      return res.text().then(function(body) {
+        if (!res.ok) {
+          throw new Error(body.trim() || res.statusText);
+        }
+        state.token = body.trim();
+        state.version = 0;
+      });
+    });
+  }
+
+  // Fetches the group's stats, then keeps waiting for them to change
+  function poll(session) {
+    var params = {t: state.token};
+    if (state.version) {
+      params.wait = POLL_WAIT;
+      params.since = state.version;
+    }
+    fetch('/api/v2/stats?' + query(params), {headers: {Accept: 'application/json'}}).then(function(res) {
+      if (session !== state.session) {
+        return;
+      }
+      if (res.status === 400) {
+        // Connections are dropped after a while without activity
+        return reconnect(session);
+      } else if (res.status === 429) {
+        var wait = parseInt(res.headers.get('Retry-After'), 10) || 1;
+        setTimeout(function() { poll(session); }, wait * 1000);
+        return;
+      } else if (!res.ok) {
+        throw new Error(res.statusText);
+      }
+      return res.json().then(function(members) {
+        if (session !== state.session) {
+          return;
+        }
+        state.version = parseInt(res.headers.get('X-Stats-Version'), 10) || 0;
+        state.live = members || [];
+        setStatus('Live', false);
+        if (state.selected === 'live') {
+          render();
+        }
+        poll(session);
+      });
+    }).catch(function() {
+      if (session !== state.session) {
+        return;
+      }
+      setStatus('Reconnecting…', true);
+      setTimeout(function() { poll(session); }, RETRY_DELAY);
+    });
+  }
+
+  function reconnect(session) {
+    setStatus('Reconnecting…', true);
+    return connect().then(function() {
+      if (session === state.session) {
+        poll(session);
+      }
+    }, function(err) {
+      if (session !== state.session) {
+        return;
+      }
+      // The password was changed or the group is gone
+      logout();
+      $('login-error').textContent = err.message;
+    });
+  }
+
+  function setStatus(text, offline) {
+    $('status').textContent = text;
+    $('status').classList.toggle('offline', offline);
+  }
+
+  // Encounter and difficulty names, for encounters in progress
+  function loadCatalog() {
+    fetch('/api/v2/encounters').then(function(res) {
+      return res.ok ? res.json() : null;
+    }).then(function(data) {
+      if (!data) {
+        return;
+      }
+      (data.encounters || []).forEach(function(e) { state.encounters[e.id] = e; });
+      (data.modes || []).forEach(function(m) { state.modes[m.id] = m; });
+      render();
+    }).catch(function() {});
+  }
+
+  // Lists recently finished fights, refreshing them every so often
+  function loadHistory(session) {
+    if (session !== state.session) {
+      return;
+    }
+    var from = new Date(Date.now() - HISTORY_DAYS * 86400000).toISOString().replace(/\.\d+Z$/, 'Z');
+    var url = '/api/v2/export?' + query({t: state.token, format: 'ndjson', from: from});
+    fetch(url).then(function(res) {
+      return res.ok ? res.text() : null;
+    }).then(function(body) {
+      if (session !== state.session || body === null) {
+        return;
+      }
+      var rows = body.split('\n').filter(Boolean).map(function(line) { return JSON.parse(line); });
+      state.fights = groupFights(rows);
+      renderEncounters();
+      if (state.selected !== 'live') {
+        render();
+      }
+    }).catch(function() {}).then(function() {
+      setTimeout(function() { loadHistory(session); }, HISTORY_REFRESH);
+    });
+  }
+
+  // Groups each player's result into the fights they were part of
+  function groupFights(rows) {
+    rows.sort(function(a, b) { return parseTime(a.CombatStart) - parseTime(b.CombatStart); });
+    var fights = [];
+    rows.forEach(function(row) {
+      var start = parseTime(row.CombatStart);
+      var key = [row.RaidEncounterId, row.RaidEncounterMode, row.RaidEncounterPlayers].join('-');
+      var fight = null;
+      for (var i = fights.length - 1; i >= 0 && start - fights[i].start <= FIGHT_WINDOW; i--) {
+        if (fights[i].key === key) {
+          fight = fights[i];
+          break;
+        }
+      }
+      if (!fight) {
+        fight = {key: key, start: start, end: 0, duration: 0, rows: [], first: row};
+        fight.id = key + '@' + start;
+        fights.push(fight);
+      }
+      fight.rows.push(row);
+      fight.end = Math.max(fight.end, parseTime(row.CombatEnd));
+      fight.duration = Math.max(fight.duration, row.Duration);
+    });
+    return fights.reverse();
+  }
+
+  function renderEncounters() {
+    var select = $('encounter');
+    while (select.options.length > 1) {
+      select.remove(1);
+    }
+    var found = state.selected === 'live';
+    state.fights.forEach(function(fight) {
+      var label = fightName(fight.first) + ' — ' + new Date(fight.start).toLocaleString();
+      select.add(new Option(label, fight.id));
+      found = found || fight.id === state.selected;
+    });
+    if (!found) {
+      state.selected = 'live';
+      render();
+    }
+    select.value = state.selected;
+  }
+
+  function render() {
+    var metric = METRICS[state.metric];
+    var members;
+    if (state.selected === 'live') {
+      members = liveMembers();
+    } else {
+      members = fightMembers();
+    }
+    if (!members) {
+      return;
+    }
+
+    // Totals and rates for the selected metric
+    var total = 0;
+    var max = 0;
+    members.forEach(function(m) {
+      m.value = m.stats[metric.field] || 0;
+      m.rate = m.seconds > 0 ? m.value / m.seconds : 0;
+      total += m.value;
+      max = Math.max(max, state.sort === 'rate' ? m.rate : m.value);
+    });
+    members.sort(compare);
+
+    var list = $('meters');
+    var template = $('meter');
+    list.textContent = '';
+    members.forEach(function(m, i) {
+      var item = template.content.firstElementChild.cloneNode(true);
+      var value = state.sort === 'rate' ? m.rate : m.value;
+      item.classList.add(m.role || 'unknown');
+      item.querySelector('.bar').style.width = (max > 0 ? value / max * 100 : 0) + '%';
+      item.querySelector('.rank').textContent = i + 1;
+      item.querySelector('.name').textContent = m.name;
+      item.querySelector('.total').textContent = formatNumber(m.value);
+      item.querySelector('.rate').textContent = formatNumber(m.rate) + '/s';
+      item.querySelector('.share').textContent = total > 0 ? Math.round(m.value / total * 100) + '%' : '';
+      if (m.flags) {
+        var flags = item.querySelector('.flags');
+        flags.textContent = '⚑';
+        flags.title = 'Flagged, not ranked: ' + m.flags.split(',').join(', ');
+      }
+      list.appendChild(item);
+    });
+
+    var empty = $('empty');
+    empty.hidden = members.length > 0;
+    empty.textContent = state.selected === 'live' ? 'Nobody in the group has sent stats yet.' : 'Nobody finished this encounter.';
+  }
+
+  function compare(a, b) {
+    if (state.sort === 'name') {
+      return a.name.localeCompare(b.name);
+    } else if (state.sort === 'rate') {
+      return b.rate - a.rate || a.name.localeCompare(b.name);
+    }
+    return b.value - a.value || a.name.localeCompare(b.name);
+  }
+
+  // Everyone's stats for the encounter they're in now, or were in last
+  function liveMembers() {
+    var now = Date.now();
+    var latest = null;
+    var inCombat = false;
+    var members = state.live.filter(function(s) { return s.CharacterName; }).map(function(s) {
+      var start = parseTime(s.CombatStart);
+      var end = parseTime(s.CombatEnd);
+      var fighting = start > 0 && end < start;
+      if (s.RaidEncounterId && (!latest || start > parseTime(latest.CombatStart))) {
+        latest = s;
+      }
+      inCombat = inCombat || fighting;
+      return {name: s.CharacterName, role: s.Role, stats: s, seconds: liveSeconds(s, start, end, now)};
+    });
+
+    $('encounter-title').textContent = latest ? fightName(latest) : 'Live';
+    var details = [inCombat ? 'In combat' : 'Out of combat', members.length + (members.length === 1 ? ' member' : ' members')];
+    if (latest) {
+      details.push('started ' + new Date(parseTime(latest.CombatStart)).toLocaleTimeString());
+    }
+    $('encounter-details').textContent = details.join(' · ');
+    return members;
+  }
+
+  function fightMembers() {
+    var fight = null;
+    state.fights.forEach(function(f) {
+      if (f.id === state.selected) {
+        fight = f;
+      }
+    });
+    if (!fight) {
+      return null;
+    }
+
+    $('encounter-title').textContent = fightName(fight.first);
+    var details = [
+      new Date(fight.start).toLocaleString(),
+      formatDuration(fight.duration),
+      fight.rows.length + (fight.rows.length === 1 ? ' player' : ' players')
+    ];
+    $('encounter-details').textContent = details.join(' · ');
+    return fight.rows.map(function(row) {
+      return {name: row.CharacterName, role: '', stats: row, seconds: row.Duration, flags: row.Flags};
+    });
+  }
+
+  // Matches how the server measures an encounter: the client's own count of
+  // time in combat, or else the combat start and end
+  function liveSeconds(s, start, end, now) {
+    if (s.CombatTicks > 0) {
+      return s.CombatTicks / 1e7;
+    }
+    if (start <= 0) {
+      return 0;
+    }
+    return ((end < start ? now : end) - start) / 1000;
+  }
+
+  // Names an encounter from an export row, or from the catalog for live stats
+  function fightName(s) {
+    var boss = s.Boss;
+    var difficulty = s.Difficulty;
+    if (!boss) {
+      var encounter = state.encounters[s.RaidEncounterId];
+      boss = encounter ? encounter.boss : 'Encounter ' + s.RaidEncounterId;
+    }
+    if (!difficulty) {
+      var mode = state.modes[s.RaidEncounterMode];
+      difficulty = mode ? mode.difficulty : '';
+    }
+    var players = s.RaidEncounterPlayers ? s.RaidEncounterPlayers + ' players' : '';
+    var details = [difficulty, players].filter(Boolean).join(', ');
+    return details ? boss + ' (' + details + ')' : boss;
+  }
+
+  // Times are RFC 3339 with up to nanoseconds, and zero if unset
+  function parseTime(value) {
+    var t = Date.parse(String(value || '').replace(/(\.\d{3})\d+/, '$1'));
+    return t > 0 ? t : 0;
+  }
+
+  function formatNumber(n) {
+    if (n >= 1e6) {
+      return (n / 1e6).toFixed(2) + 'M';
+    } else if (n >= 1e4) {
+      return (n / 1e3).toFixed(1) + 'k';
+    }
+    return Math.round(n).toLocaleString();
+  }
+
+  function formatDuration(seconds) {
+    seconds = Math.round(seconds);
+    var s = seconds % 60;
+    return Math.floor(seconds / 60) + ':' + (s < 10 ? '0' : '') + s;
+  }
+
+  function query(params) {
+    return new URLSearchParams(params).toString();
+  }
+
+  init();
+})();
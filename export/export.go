@@ -0,0 +1,275 @@
+// Package export writes finished encounters out as CSV, newline-delimited
+// JSON or Parquet for analysis in other tools. Rows are written as they're
+// read, so large exports don't have to fit in memory.
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/warhammerkid/parsec-go/catalog"
+	"github.com/warhammerkid/parsec-go/leaderboard"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	CSV     = "csv"
+	NDJSON  = "ndjson"
+	Parquet = "parquet"
+
+	// Rows per Parquet row group. Kept small so rows are flushed to the
+	// output regularly instead of buffered until the end.
+	parquetRowGroupSize = 4 * 1024 * 1024
+)
+
+var Formats = []string{CSV, NDJSON, Parquet}
+
+var ErrUnknownFormat = errors.New("export: unknown format")
+
+// A single player's numbers for a finished encounter, with the encounter
+// names and per-second rates filled in
+type Row struct {
+	GroupName            string
+	RaidUserId           int32
+	CharacterName        string
+	RaidEncounterId      int32
+	RaidEncounterMode    int32
+	RaidEncounterPlayers int32
+	Operation            string
+	Boss                 string
+	Difficulty           string
+	CombatStart          time.Time
+	CombatEnd            time.Time
+	CombatTicks          int64
+	Duration             float64 // Seconds
+	DamageOut            int64
+	DamageIn             int64
+	HealOut              int64
+	EffectiveHealOut     int64
+	HealIn               int64
+	Threat               int64
+	DPS                  float64
+	HPS                  float64
+	EHPS                 float64
+	DTPS                 float64 // Damage taken per second
+	HTPS                 float64 // Healing taken per second
+	TPS                  float64 // Threat per second
+	Flags                string  // Comma-separated reasons the result looks implausible
+}
+
+// NewRow builds a row from a recorded result, resolving names from the catalog
+func NewRow(groupName string, result leaderboard.Result, encounters *catalog.Catalog) *Row {
+	resolved := encounters.Resolve(result.RaidEncounterId, result.RaidEncounterMode, result.RaidEncounterPlayers)
+	row := &Row{
+		GroupName:            groupName,
+		RaidUserId:           result.RaidUserId,
+		CharacterName:        result.CharacterName,
+		RaidEncounterId:      result.RaidEncounterId,
+		RaidEncounterMode:    result.RaidEncounterMode,
+		RaidEncounterPlayers: result.RaidEncounterPlayers,
+		Operation:            resolved.Operation,
+		Boss:                 resolved.Boss,
+		Difficulty:           resolved.Difficulty,
+		CombatStart:          result.CombatStart,
+		CombatEnd:            result.CombatEnd,
+		CombatTicks:          result.CombatTicks,
+		Duration:             result.Duration.Seconds(),
+		DamageOut:            result.DamageOut,
+		DamageIn:             result.DamageIn,
+		HealOut:              result.HealOut,
+		EffectiveHealOut:     result.EffectiveHealOut,
+		HealIn:               result.HealIn,
+		Threat:               result.Threat,
+		Flags:                strings.Join(result.Flags, ","),
+	}
+	if row.Duration > 0 {
+		row.DPS = float64(row.DamageOut) / row.Duration
+		row.HPS = float64(row.HealOut) / row.Duration
+		row.EHPS = float64(row.EffectiveHealOut) / row.Duration
+		row.DTPS = float64(row.DamageIn) / row.Duration
+		row.HTPS = float64(row.HealIn) / row.Duration
+		row.TPS = float64(row.Threat) / row.Duration
+	}
+	return row
+}
+
+// Writer streams rows out in one of the export formats. Close must be called
+// to finish the output, but doesn't close the underlying writer.
+type Writer interface {
+	Write(row *Row) error
+	Close() error
+}
+
+// NewWriter creates a writer for the given format
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case CSV:
+		return newCSVWriter(w), nil
+	case NDJSON:
+		return &ndjsonWriter{encoder: json.NewEncoder(w)}, nil
+	case Parquet:
+		return newParquetWriter(w)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// ContentType returns the media type for a format
+func ContentType(format string) string {
+	switch format {
+	case CSV:
+		return "text/csv; charset=utf-8"
+	case NDJSON:
+		return "application/x-ndjson"
+	}
+	return "application/vnd.apache.parquet"
+}
+
+var csvHeader = []string{
+	"GroupName", "RaidUserId", "CharacterName", "RaidEncounterId", "RaidEncounterMode", "RaidEncounterPlayers",
+	"Operation", "Boss", "Difficulty", "CombatStart", "CombatEnd", "CombatTicks", "Duration",
+	"DamageOut", "DamageIn", "HealOut", "EffectiveHealOut", "HealIn", "Threat",
+	"DPS", "HPS", "EHPS", "DTPS", "HTPS", "TPS", "Flags",
+}
+
+type csvWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (c *csvWriter) Write(row *Row) error {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		err := c.w.Write(csvHeader)
+		if err != nil {
+			return err
+		}
+	}
+
+	i32 := func(v int32) string { return strconv.FormatInt(int64(v), 10) }
+	i64 := func(v int64) string { return strconv.FormatInt(v, 10) }
+	f64 := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	err := c.w.Write([]string{
+		row.GroupName, i32(row.RaidUserId), row.CharacterName, i32(row.RaidEncounterId), i32(row.RaidEncounterMode),
+		i32(row.RaidEncounterPlayers), row.Operation, row.Boss, row.Difficulty,
+		row.CombatStart.UTC().Format(time.RFC3339Nano), row.CombatEnd.UTC().Format(time.RFC3339Nano),
+		i64(row.CombatTicks), f64(row.Duration),
+		i64(row.DamageOut), i64(row.DamageIn), i64(row.HealOut), i64(row.EffectiveHealOut), i64(row.HealIn), i64(row.Threat),
+		f64(row.DPS), f64(row.HPS), f64(row.EHPS), f64(row.DTPS), f64(row.HTPS), f64(row.TPS), row.Flags,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Flush every row so the output streams
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) Close() error {
+	// An empty export still gets a header
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		c.w.Write(csvHeader)
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonWriter struct {
+	encoder *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(row *Row) error {
+	return n.encoder.Encode(row)
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
+
+// Row layout for Parquet, which wants plain numeric timestamps
+type parquetRow struct {
+	GroupName            string  `parquet:"name=group_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	RaidUserId           int32   `parquet:"name=raid_user_id, type=INT32"`
+	CharacterName        string  `parquet:"name=character_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	RaidEncounterId      int32   `parquet:"name=raid_encounter_id, type=INT32"`
+	RaidEncounterMode    int32   `parquet:"name=raid_encounter_mode, type=INT32"`
+	RaidEncounterPlayers int32   `parquet:"name=raid_encounter_players, type=INT32"`
+	Operation            string  `parquet:"name=operation, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Boss                 string  `parquet:"name=boss, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Difficulty           string  `parquet:"name=difficulty, type=BYTE_ARRAY, convertedtype=UTF8"`
+	CombatStart          int64   `parquet:"name=combat_start, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	CombatEnd            int64   `parquet:"name=combat_end, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	CombatTicks          int64   `parquet:"name=combat_ticks, type=INT64"`
+	Duration             float64 `parquet:"name=duration, type=DOUBLE"`
+	DamageOut            int64   `parquet:"name=damage_out, type=INT64"`
+	DamageIn             int64   `parquet:"name=damage_in, type=INT64"`
+	HealOut              int64   `parquet:"name=heal_out, type=INT64"`
+	EffectiveHealOut     int64   `parquet:"name=effective_heal_out, type=INT64"`
+	HealIn               int64   `parquet:"name=heal_in, type=INT64"`
+	Threat               int64   `parquet:"name=threat, type=INT64"`
+	DPS                  float64 `parquet:"name=dps, type=DOUBLE"`
+	HPS                  float64 `parquet:"name=hps, type=DOUBLE"`
+	EHPS                 float64 `parquet:"name=ehps, type=DOUBLE"`
+	DTPS                 float64 `parquet:"name=dtps, type=DOUBLE"`
+	HTPS                 float64 `parquet:"name=htps, type=DOUBLE"`
+	TPS                  float64 `parquet:"name=tps, type=DOUBLE"`
+	Flags                string  `parquet:"name=flags, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+type parquetWriter struct {
+	w *writer.ParquetWriter
+}
+
+func newParquetWriter(w io.Writer) (*parquetWriter, error) {
+	pw, err := writer.NewParquetWriterFromWriter(w, new(parquetRow), 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.RowGroupSize = parquetRowGroupSize
+	return &parquetWriter{w: pw}, nil
+}
+
+func (p *parquetWriter) Write(row *Row) error {
+	return p.w.Write(parquetRow{
+		GroupName:            row.GroupName,
+		RaidUserId:           row.RaidUserId,
+		CharacterName:        row.CharacterName,
+		RaidEncounterId:      row.RaidEncounterId,
+		RaidEncounterMode:    row.RaidEncounterMode,
+		RaidEncounterPlayers: row.RaidEncounterPlayers,
+		Operation:            row.Operation,
+		Boss:                 row.Boss,
+		Difficulty:           row.Difficulty,
+		CombatStart:          row.CombatStart.UnixNano() / int64(time.Millisecond),
+		CombatEnd:            row.CombatEnd.UnixNano() / int64(time.Millisecond),
+		CombatTicks:          row.CombatTicks,
+		Duration:             row.Duration,
+		DamageOut:            row.DamageOut,
+		DamageIn:             row.DamageIn,
+		HealOut:              row.HealOut,
+		EffectiveHealOut:     row.EffectiveHealOut,
+		HealIn:               row.HealIn,
+		Threat:               row.Threat,
+		DPS:                  row.DPS,
+		HPS:                  row.HPS,
+		EHPS:                 row.EHPS,
+		DTPS:                 row.DTPS,
+		HTPS:                 row.HTPS,
+		TPS:                  row.TPS,
+		Flags:                row.Flags,
+	})
+}
+
+func (p *parquetWriter) Close() error {
+	return p.w.WriteStop()
+}
@@ -0,0 +1,162 @@
+// Package groupname validates raid group names and normalizes them, so names
+// that only differ by case, surrounding space or look-alike Unicode forms
+// can't be registered as different groups.
+package groupname
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	MinLength = 3
+	MaxLength = 32
+
+	// Punctuation allowed in names besides letters, digits and spaces
+	allowedPunctuation = "-_.'&!#()"
+
+	selectMissingKeys = "SELECT id, name FROM raid_groups WHERE name_key IS NULL ORDER BY id"
+	selectKeyOwner    = "SELECT id, name FROM raid_groups WHERE name_key=?"
+	updateKey         = "UPDATE raid_groups SET name_key=? WHERE id=?"
+	deleteGroup       = "DELETE FROM raid_groups WHERE id=?"
+)
+
+var (
+	ErrTooShort         = errors.New("Group name must be at least 3 characters")
+	ErrTooLong          = errors.New("Group name must be at most 32 characters")
+	ErrInvalidCharacter = errors.New("Group name may only contain letters, numbers, spaces and " + allowedPunctuation)
+	ErrReserved         = errors.New("Group name is reserved")
+)
+
+// Names that could be mistaken for the server itself
+var reserved = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"api":           true,
+	"moderator":     true,
+	"null":          true,
+	"operator":      true,
+	"parsec":        true,
+	"root":          true,
+	"server":        true,
+	"support":       true,
+	"system":        true,
+	"undefined":     true,
+}
+
+// Tables holding a group's roles, invites, bans and character claims, which are
+// deleted along with it. Leaderboard results are kept.
+var groupTables = []string{"raid_group_roles", "raid_group_invites", "raid_group_bans", "raid_group_characters"}
+
+// A legacy group whose name normalizes to the same key as an earlier group
+type Collision struct {
+	Id           uint32
+	Name         string
+	ConflictId   uint32
+	ConflictName string
+}
+
+// Display returns the name as it should be stored and shown: NFKC normalized,
+// trimmed, with runs of whitespace collapsed to a single space
+func Display(name string) string {
+	return strings.Join(strings.Fields(norm.NFKC.String(name)), " ")
+}
+
+// Key returns the form of the name used for uniqueness and lookups
+func Key(name string) string {
+	return norm.NFKC.String(cases.Fold().String(Display(name)))
+}
+
+// Validate checks a requested name, returning its display form and key
+func Validate(name string) (string, string, error) {
+	display := Display(name)
+	length := utf8.RuneCountInString(display)
+	if length < MinLength {
+		return "", "", ErrTooShort
+	} else if length > MaxLength {
+		return "", "", ErrTooLong
+	}
+	for _, r := range display {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.Is(unicode.Mn, r) && r != ' ' && !strings.ContainsRune(allowedPunctuation, r) {
+			return "", "", ErrInvalidCharacter
+		}
+	}
+	key := Key(display)
+	if reserved[key] {
+		return "", "", ErrReserved
+	}
+	return display, key, nil
+}
+
+// Backfill sets the key for groups created before keys were stored. Groups
+// whose key is already taken are left without one, so they can still be
+// found by their exact name, and are returned for the operator to resolve.
+func Backfill(db *sql.DB) ([]Collision, error) {
+	rows, err := db.Query(selectMissingKeys)
+	if err != nil {
+		return nil, err
+	}
+	type group struct {
+		id   uint32
+		name string
+	}
+	groups := make([]group, 0, 16)
+	for rows.Next() {
+		var g group
+		err = rows.Scan(&g.id, &g.name)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	rows.Close()
+
+	collisions := make([]Collision, 0)
+	for _, g := range groups {
+		key := Key(g.name)
+		var c Collision
+		err = db.QueryRow(selectKeyOwner, key).Scan(&c.ConflictId, &c.ConflictName)
+		if err == nil {
+			c.Id = g.id
+			c.Name = g.name
+			collisions = append(collisions, c)
+			continue
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+		_, err = db.Exec(updateKey, key, g.id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return collisions, nil
+}
+
+// Delete removes a group along with its roles, invites, bans and character
+// claims. Its webhooks are removed by sending them the group deleted event.
+func Delete(db *sql.DB, groupId uint32) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range groupTables {
+		_, err = tx.Exec("DELETE FROM " + table + " WHERE group_id=?", groupId)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec(deleteGroup, groupId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,168 @@
+// Package history keeps a bounded record of each player's cumulative totals
+// over the course of an encounter, so they can be graphed as rates over time.
+package history
+
+import (
+	"time"
+)
+
+// Cumulative totals as of a point in time
+type Snapshot struct {
+	Time             time.Time
+	DamageOut        int64
+	DamageIn         int64
+	HealOut          int64
+	EffectiveHealOut int64
+	HealIn           int64
+	Threat           int64
+}
+
+// Per-second rates over one bucket of an encounter
+type Bucket struct {
+	Offset           float64 // Seconds from the start of combat
+	DamageOut        float64
+	DamageIn         float64
+	HealOut          float64
+	EffectiveHealOut float64
+	HealIn           float64
+	Threat           float64
+}
+
+// Ring holds the most recent snapshots for a single encounter, dropping the
+// oldest once full
+type Ring struct {
+	combatStart time.Time
+	snapshots   []Snapshot
+	start       int
+	count       int
+}
+
+func NewRing(capacity int) *Ring {
+	return &Ring{snapshots: make([]Snapshot, capacity)}
+}
+
+// Add records a snapshot for the encounter that started at combatStart,
+// discarding everything from the previous encounter if this is a new one. The
+// snapshot's time must come from the same clock as combatStart, and snapshots
+// older than the latest one are ignored.
+func (r *Ring) Add(combatStart time.Time, s Snapshot) {
+	if !combatStart.Equal(r.combatStart) {
+		r.combatStart = combatStart
+		r.start = 0
+		r.count = 0
+
+		// Totals are zero at the start of combat
+		if combatStart.Before(s.Time) {
+			r.push(Snapshot{Time: combatStart})
+		}
+	} else if r.count > 0 && s.Time.Before(r.latest().Time) {
+		return
+	}
+	r.push(s)
+}
+
+func (r *Ring) latest() Snapshot {
+	return r.snapshots[(r.start+r.count-1)%len(r.snapshots)]
+}
+
+func (r *Ring) push(s Snapshot) {
+	if r.count < len(r.snapshots) {
+		r.snapshots[(r.start+r.count)%len(r.snapshots)] = s
+		r.count++
+	} else {
+		r.snapshots[r.start] = s
+		r.start = (r.start + 1) % len(r.snapshots)
+	}
+}
+
+// CombatStart returns the start of the encounter being recorded
+func (r *Ring) CombatStart() time.Time {
+	return r.combatStart
+}
+
+// Snapshots returns a copy of the recorded snapshots, oldest first
+func (r *Ring) Snapshots() []Snapshot {
+	snapshots := make([]Snapshot, r.count)
+	for i := 0; i < r.count; i++ {
+		snapshots[i] = r.snapshots[(r.start+i)%len(r.snapshots)]
+	}
+	return snapshots
+}
+
+// Buckets converts cumulative snapshots into per-second rates over buckets of
+// the given width, aligned to origin. Totals are interpolated linearly between
+// snapshots, and buckets before the first snapshot are skipped.
+func Buckets(snapshots []Snapshot, origin time.Time, width time.Duration) []Bucket {
+	if len(snapshots) == 0 || width <= 0 {
+		return []Bucket{}
+	}
+
+	// Start at the first bucket boundary we have data for
+	first := snapshots[0].Time
+	end := snapshots[len(snapshots)-1].Time
+	bucketStart := first
+	if !origin.IsZero() && origin.Before(first) {
+		bucketStart = origin.Add((first.Sub(origin) + width - 1) / width * width)
+	} else {
+		origin = first
+	}
+
+	buckets := make([]Bucket, 0, int(end.Sub(bucketStart)/width)+1)
+	j := 0
+	valueAt := func(t time.Time) Snapshot {
+		for j < len(snapshots)-1 && snapshots[j+1].Time.Before(t) {
+			j++
+		}
+		after := j
+		if j < len(snapshots)-1 {
+			after = j + 1
+		}
+		return interpolate(snapshots[j], snapshots[after], t)
+	}
+
+	prev := valueAt(bucketStart)
+	for ; bucketStart.Before(end); bucketStart = bucketStart.Add(width) {
+		bucketEnd := bucketStart.Add(width)
+		if bucketEnd.After(end) {
+			bucketEnd = end
+		}
+		next := valueAt(bucketEnd)
+
+		seconds := bucketEnd.Sub(bucketStart).Seconds()
+		buckets = append(buckets, Bucket{
+			Offset:           bucketStart.Sub(origin).Seconds(),
+			DamageOut:        float64(next.DamageOut-prev.DamageOut) / seconds,
+			DamageIn:         float64(next.DamageIn-prev.DamageIn) / seconds,
+			HealOut:          float64(next.HealOut-prev.HealOut) / seconds,
+			EffectiveHealOut: float64(next.EffectiveHealOut-prev.EffectiveHealOut) / seconds,
+			HealIn:           float64(next.HealIn-prev.HealIn) / seconds,
+			Threat:           float64(next.Threat-prev.Threat) / seconds,
+		})
+		prev = next
+	}
+	return buckets
+}
+
+// Estimates totals at t from the snapshots either side of it
+func interpolate(a Snapshot, b Snapshot, t time.Time) Snapshot {
+	span := b.Time.Sub(a.Time)
+	if span <= 0 || !t.After(a.Time) {
+		return a
+	}
+	if !t.Before(b.Time) {
+		return b
+	}
+	f := float64(t.Sub(a.Time)) / float64(span)
+	lerp := func(x int64, y int64) int64 {
+		return x + int64(f*float64(y-x))
+	}
+	return Snapshot{
+		Time:             t,
+		DamageOut:        lerp(a.DamageOut, b.DamageOut),
+		DamageIn:         lerp(a.DamageIn, b.DamageIn),
+		HealOut:          lerp(a.HealOut, b.HealOut),
+		EffectiveHealOut: lerp(a.EffectiveHealOut, b.EffectiveHealOut),
+		HealIn:           lerp(a.HealIn, b.HealIn),
+		Threat:           lerp(a.Threat, b.Threat),
+	}
+}
@@ -0,0 +1,239 @@
+// Package identity lets players claim a character within a raid group with a
+// personal secret, so nobody else in the group can report stats as them.
+// Claims are optional, and characters nobody has claimed can still be used by
+// anyone who knows the group password.
+package identity
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/warhammerkid/parsec-go/groupname"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	MinSecretLength = 8
+	MaxSecretLength = 72 // bcrypt ignores anything longer
+
+	insertClaim  = "INSERT OR IGNORE INTO raid_group_characters VALUES (?, ?, ?, ?, ?)"
+	deleteClaim  = "DELETE FROM raid_group_characters WHERE group_id=? AND character_key=?"
+	selectSecret = "SELECT secret_hash FROM raid_group_characters WHERE group_id=? AND character_key=?"
+	selectClaims = "SELECT character_name, datetime FROM raid_group_characters WHERE group_id=? ORDER BY character_key"
+
+	selectAllClaims = "SELECT group_id, character_key, character_name FROM raid_group_characters ORDER BY datetime, rowid"
+	selectClaimName = "SELECT character_name FROM raid_group_characters WHERE group_id=? AND character_key=?"
+	rekeyClaim      = "UPDATE OR IGNORE raid_group_characters SET character_key=? WHERE group_id=? AND character_key=?"
+)
+
+var (
+	ErrWrongSecret    = errors.New("Invalid character secret")
+	ErrAlreadyClaimed = errors.New("Character has already been claimed")
+	ErrSecretLength   = errors.New("Character secret must be between 8 and 72 characters")
+)
+
+// A claimed character, without its secret
+type Claim struct {
+	CharacterName string
+	Created       string
+}
+
+type Store struct {
+	insertStmt *sql.Stmt
+	deleteStmt *sql.Stmt
+	secretStmt *sql.Stmt
+	claimsStmt *sql.Stmt
+
+	// Digests of secrets that have already passed bcrypt, so clients that
+	// send their secret with every request don't pay for it each time
+	verifiedLock sync.Mutex
+	verified     map[claimKey][sha256.Size]byte
+}
+
+type claimKey struct {
+	groupId   uint32
+	character string
+}
+
+// NewStore prepares the store's queries. The table is created by migrations.
+func NewStore(db *sql.DB) (*Store, error) {
+	s := &Store{verified: map[claimKey][sha256.Size]byte{}}
+	var err error
+	s.insertStmt, err = db.Prepare(insertClaim)
+	if err != nil {
+		return nil, err
+	}
+	s.deleteStmt, err = db.Prepare(deleteClaim)
+	if err != nil {
+		return nil, err
+	}
+	s.secretStmt, err = db.Prepare(selectSecret)
+	if err != nil {
+		return nil, err
+	}
+	s.claimsStmt, err = db.Prepare(selectClaims)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Key returns the form of a character name claims are matched by, normalized
+// like group names so look-alike forms of a name match it
+func Key(character string) string {
+	return groupname.Key(character)
+}
+
+// A claim dropped by Rekey because an earlier claim has the same key
+type Collision struct {
+	GroupId       uint32
+	CharacterName string
+	ConflictName  string
+}
+
+// Rekey updates the keys of claims made before Key normalized names the way it
+// does now. If two claims in a group end up with the same key, only the one
+// that got it first is kept, and the other is dropped and returned so the
+// operator can tell its player to claim the character again.
+func Rekey(db *sql.DB) ([]Collision, error) {
+	rows, err := db.Query(selectAllClaims)
+	if err != nil {
+		return nil, err
+	}
+	type claim struct {
+		groupId   uint32
+		key       string
+		character string
+	}
+	stale := make([]claim, 0)
+	for rows.Next() {
+		var c claim
+		err = rows.Scan(&c.groupId, &c.key, &c.character)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if c.key != Key(c.character) {
+			stale = append(stale, c)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	collisions := make([]Collision, 0)
+	for _, c := range stale {
+		result, err := db.Exec(rekeyClaim, Key(c.character), c.groupId, c.key)
+		if err != nil {
+			return nil, err
+		}
+		if affected, _ := result.RowsAffected(); affected > 0 {
+			continue
+		}
+		collision := Collision{GroupId: c.groupId, CharacterName: c.character}
+		db.QueryRow(selectClaimName, c.groupId, Key(c.character)).Scan(&collision.ConflictName)
+		_, err = db.Exec(deleteClaim, c.groupId, c.key)
+		if err != nil {
+			return nil, err
+		}
+		collisions = append(collisions, collision)
+	}
+	return collisions, nil
+}
+
+// Claim registers the character to whoever knows the secret
+func (s *Store) Claim(groupId uint32, character string, secret string) error {
+	if len(secret) < MinSecretLength || len(secret) > MaxSecretLength {
+		return ErrSecretLength
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	result, err := s.insertStmt.Exec(groupId, Key(character), strings.TrimSpace(character), string(hash), time.Now().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrAlreadyClaimed
+	}
+	return nil
+}
+
+// Verify checks a secret for the character, returning whether it has been
+// claimed. Unclaimed characters pass with any secret.
+func (s *Store) Verify(groupId uint32, character string, secret string) (bool, error) {
+	var hash string
+	err := s.secretStmt.QueryRow(groupId, Key(character)).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	key := claimKey{groupId, Key(character)}
+	digest := sha256.Sum256([]byte(hash + "\x00" + secret))
+	s.verifiedLock.Lock()
+	cached, ok := s.verified[key]
+	s.verifiedLock.Unlock()
+	if ok && cached == digest {
+		return true, nil
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) != nil {
+		return true, ErrWrongSecret
+	}
+	s.verifiedLock.Lock()
+	s.verified[key] = digest
+	s.verifiedLock.Unlock()
+	return true, nil
+}
+
+// Claimed returns whether anyone has claimed the character
+func (s *Store) Claimed(groupId uint32, character string) (bool, error) {
+	var hash string
+	err := s.secretStmt.QueryRow(groupId, Key(character)).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Release removes a claim, for when a player has forgotten their secret.
+// Returns false if the character wasn't claimed.
+func (s *Store) Release(groupId uint32, character string) (bool, error) {
+	result, err := s.deleteStmt.Exec(groupId, Key(character))
+	if err != nil {
+		return false, err
+	}
+	s.verifiedLock.Lock()
+	delete(s.verified, claimKey{groupId, Key(character)})
+	s.verifiedLock.Unlock()
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// List returns the group's claimed characters
+func (s *Store) List(groupId uint32) ([]Claim, error) {
+	rows, err := s.claimsStmt.Query(groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	claims := make([]Claim, 0, 8)
+	for rows.Next() {
+		var c Claim
+		err = rows.Scan(&c.CharacterName, &c.Created)
+		if err != nil {
+			return nil, err
+		}
+		claims = append(claims, c)
+	}
+	return claims, rows.Err()
+}
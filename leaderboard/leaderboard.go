@@ -0,0 +1,416 @@
+// Package leaderboard stores finished encounters and ranks players by their
+// throughput per encounter, difficulty and group size. Results flagged as
+// implausible are kept for review but never ranked.
+package leaderboard
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/warhammerkid/parsec-go/stats"
+)
+
+// Metrics players can be ranked by
+const (
+	DPS  = "dps"
+	HPS  = "hps"
+	EHPS = "ehps"
+)
+
+const (
+	insertResult = `INSERT OR REPLACE INTO encounter_results (group_id, character_name, raid_encounter_id, raid_encounter_mode, raid_encounter_players,
+		combat_start, combat_end, duration, damage_out, damage_in, heal_out, effective_heal_out, heal_in, threat, dps, hps, ehps,
+		raid_user_id, combat_ticks, flags)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	// Results for a group between two combat start times, optionally limited
+	// to an encounter
+	selectResults = `SELECT raid_user_id, character_name, raid_encounter_id, raid_encounter_mode, raid_encounter_players,
+		combat_start, combat_end, duration, combat_ticks, damage_out, damage_in, heal_out, effective_heal_out, heal_in, threat, flags
+		FROM encounter_results WHERE group_id=?1 AND combat_start >= ?2 AND combat_start < ?3
+		AND (?4=0 OR (raid_encounter_id=?4 AND raid_encounter_mode=?5 AND raid_encounter_players=?6))
+		ORDER BY combat_start, character_name`
+	selectPersonalBest = `SELECT MAX(dps), MAX(hps), MAX(ehps) FROM encounter_results
+		WHERE group_id=? AND character_name=? AND raid_encounter_id=? AND raid_encounter_mode=? AND raid_encounter_players=? AND flags=''`
+	selectPersonalBests = `SELECT raid_encounter_id, raid_encounter_mode, raid_encounter_players, COUNT(*), MAX(dps), MAX(hps), MAX(ehps)
+		FROM encounter_results WHERE group_id=? AND character_name=? AND flags=''
+		GROUP BY raid_encounter_id, raid_encounter_mode, raid_encounter_players
+		ORDER BY raid_encounter_id, raid_encounter_mode, raid_encounter_players`
+
+	// Each player's best result for an encounter, optionally limited to a
+	// group. Metric is substituted in from a fixed list, never user input.
+	selectTopFormat = `SELECT r.group_id, r.character_name, r.%[1]s, r.duration, r.combat_start FROM encounter_results r
+		JOIN (SELECT group_id, character_name, MAX(%[1]s) AS best FROM encounter_results
+			WHERE raid_encounter_id=?1 AND raid_encounter_mode=?2 AND raid_encounter_players=?3 AND (?4=0 OR group_id=?4) AND flags=''
+			GROUP BY group_id, character_name) b
+		ON r.group_id=b.group_id AND r.character_name=b.character_name AND r.%[1]s=b.best
+		WHERE r.raid_encounter_id=?1 AND r.raid_encounter_mode=?2 AND r.raid_encounter_players=?3 AND r.flags=''
+		GROUP BY r.group_id, r.character_name
+		ORDER BY r.%[1]s DESC LIMIT ?5`
+
+	// How an encounter's unflagged DPS and HPS are distributed across the
+	// server, to spot results far outside it
+	selectDistribution = `SELECT COUNT(*), COALESCE(AVG(dps), 0), COALESCE(AVG(dps*dps), 0), COALESCE(AVG(hps), 0), COALESCE(AVG(hps*hps), 0)
+		FROM encounter_results WHERE raid_encounter_id=? AND raid_encounter_mode=? AND raid_encounter_players=? AND flags=''`
+
+	// Members of a group in the same fight start combat at slightly different
+	// times, so a fight is every result for the encounter starting within
+	// a window. Takes the group and encounter, then the window's bounds.
+	matchFight = `group_id=?1 AND raid_encounter_id=?2 AND raid_encounter_mode=?3 AND raid_encounter_players=?4
+		AND combat_start >= ?5 AND combat_start < ?6`
+	selectFightDamage = "SELECT COALESCE(SUM(damage_out), 0) FROM encounter_results WHERE " + matchFight
+	flagFight = `UPDATE encounter_results SET flags=CASE WHEN flags='' THEN ?7 ELSE flags || ',' || ?7 END
+		WHERE ` + matchFight + ` AND ',' || flags || ',' NOT LIKE '%,' || ?7 || ',%'`
+
+	// Combat start times are stored as RFC3339Nano, which sorts correctly
+	// against bounds in this format
+	rangeFormat = "2006-01-02T15:04:05"
+
+	// Results shorter than this are too noisy to rank
+	MinDuration = 10 * time.Second
+
+	// How far apart members' combat start times can be for the same fight
+	FightWindow = 30 * time.Second
+)
+
+var (
+	Metrics = []string{DPS, HPS, EHPS}
+
+	ErrUnknownMetric = errors.New("Unknown leaderboard metric")
+	ErrTooShort      = errors.New("Encounter too short to rank")
+)
+
+// Identifies a boss fight at a specific difficulty and group size
+type EncounterKey struct {
+	RaidEncounterId       int32
+	RaidEncounterMode     int32
+	RaidEncounterPlayers  int32
+}
+
+// A single player's numbers for a finished encounter
+type Result struct {
+	EncounterKey
+	RaidUserId            int32
+	CharacterName         string
+	CombatStart           time.Time
+	CombatEnd             time.Time
+	Duration              time.Duration
+	CombatTicks           int64
+	DamageOut             int64
+	DamageIn              int64
+	HealOut               int64
+	EffectiveHealOut      int64
+	HealIn                int64
+	Threat                int64
+	Flags                 []string // Reasons the result looks implausible, if any
+}
+
+// Server-wide DPS and HPS for an encounter, from unflagged results
+type Distribution struct {
+	Count                 int
+	MeanDPS               float64
+	StdDevDPS             float64
+	MeanHPS               float64
+	StdDevHPS             float64
+}
+
+type Entry struct {
+	Rank                  int
+	GroupId               uint32
+	CharacterName         string
+	Value                 float64
+	Duration              float64 // Seconds
+	CombatStart           string
+}
+
+type PersonalBest struct {
+	EncounterKey
+	Encounters            int
+	DPS                   float64
+	HPS                   float64
+	EHPS                  float64
+}
+
+// Selects results for a group to export. Zero times mean unbounded, and a
+// zero encounter id means every encounter.
+type Filter struct {
+	GroupId               uint32
+	From                  time.Time
+	To                    time.Time
+	Encounter             EncounterKey
+}
+
+type Store struct {
+	db                    *sql.DB
+	insertStmt            *sql.Stmt
+	resultsStmt           *sql.Stmt
+	personalBestStmt      *sql.Stmt
+	personalBestsStmt     *sql.Stmt
+	distributionStmt      *sql.Stmt
+	fightDamageStmt       *sql.Stmt
+	flagFightStmt         *sql.Stmt
+	topStmts              map[string]*sql.Stmt
+}
+
+// NewStore prepares queries. The results table is created by migrations.
+func NewStore(db *sql.DB) (*Store, error) {
+	var err error
+	s := &Store{db: db, topStmts: map[string]*sql.Stmt{}}
+	s.insertStmt, err = db.Prepare(insertResult)
+	if err != nil {
+		return nil, err
+	}
+	s.resultsStmt, err = db.Prepare(selectResults)
+	if err != nil {
+		return nil, err
+	}
+	s.personalBestStmt, err = db.Prepare(selectPersonalBest)
+	if err != nil {
+		return nil, err
+	}
+	s.personalBestsStmt, err = db.Prepare(selectPersonalBests)
+	if err != nil {
+		return nil, err
+	}
+	s.distributionStmt, err = db.Prepare(selectDistribution)
+	if err != nil {
+		return nil, err
+	}
+	s.fightDamageStmt, err = db.Prepare(selectFightDamage)
+	if err != nil {
+		return nil, err
+	}
+	s.flagFightStmt, err = db.Prepare(flagFight)
+	if err != nil {
+		return nil, err
+	}
+	for _, metric := range Metrics {
+		s.topStmts[metric], err = db.Prepare(fmt.Sprintf(selectTopFormat, metric))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// ResultFromStats builds a result from a player's final stats for an
+// encounter
+func ResultFromStats(userStats stats.UserStats) Result {
+	result := Result{
+		EncounterKey: EncounterKey{
+			RaidEncounterId:      userStats.RaidEncounterId,
+			RaidEncounterMode:    userStats.RaidEncounterMode,
+			RaidEncounterPlayers: userStats.RaidEncounterPlayers,
+		},
+		RaidUserId:       userStats.RaidUserId,
+		CharacterName:    userStats.CharacterName,
+		CombatStart:      userStats.CombatStart.Time,
+		CombatTicks:      userStats.CombatTicks,
+		CombatEnd:        userStats.CombatEnd.Time,
+		DamageOut:        userStats.DamageOut,
+		DamageIn:         userStats.DamageIn,
+		HealOut:          userStats.HealOut,
+		EffectiveHealOut: userStats.EffectiveHealOut,
+		HealIn:           userStats.HealIn,
+		Threat:           userStats.Threat,
+	}
+
+	// Clients report duration in 100ns ticks
+	if userStats.CombatTicks > 0 {
+		result.Duration = stats.TicksDuration(userStats.CombatTicks)
+	} else {
+		result.Duration = result.CombatEnd.Sub(result.CombatStart)
+	}
+	return result
+}
+
+// Rates returns the result's DPS, HPS and effective HPS
+func (r *Result) Rates() (float64, float64, float64) {
+	seconds := r.Duration.Seconds()
+	if seconds <= 0 {
+		return 0, 0, 0
+	}
+	return float64(r.DamageOut) / seconds, float64(r.HealOut) / seconds, float64(r.EffectiveHealOut) / seconds
+}
+
+// Record saves a result for a raid group, returning the metrics it set a new
+// personal best for. Flagged results are saved but never set a best.
+func (s *Store) Record(groupId uint32, result Result) ([]string, error) {
+	if result.Duration < MinDuration {
+		return nil, ErrTooShort
+	}
+	dps, hps, ehps := result.Rates()
+	flags := strings.Join(result.Flags, ",")
+	if flags != "" {
+		_, err := s.insert(groupId, result, dps, hps, ehps, flags)
+		return nil, err
+	}
+
+	// Compare against previous bests
+	var bestDPS, bestHPS, bestEHPS sql.NullFloat64
+	err := s.personalBestStmt.QueryRow(groupId, result.CharacterName, result.RaidEncounterId, result.RaidEncounterMode,
+		result.RaidEncounterPlayers).Scan(&bestDPS, &bestHPS, &bestEHPS)
+	if err != nil {
+		return nil, err
+	}
+	newBests := make([]string, 0, len(Metrics))
+	if dps > 0 && dps > bestDPS.Float64 {
+		newBests = append(newBests, DPS)
+	}
+	if hps > 0 && hps > bestHPS.Float64 {
+		newBests = append(newBests, HPS)
+	}
+	if ehps > 0 && ehps > bestEHPS.Float64 {
+		newBests = append(newBests, EHPS)
+	}
+
+	_, err = s.insert(groupId, result, dps, hps, ehps, flags)
+	if err != nil {
+		return nil, err
+	}
+	return newBests, nil
+}
+
+func (s *Store) insert(groupId uint32, result Result, dps float64, hps float64, ehps float64, flags string) (sql.Result, error) {
+	return s.insertStmt.Exec(groupId, result.CharacterName, result.RaidEncounterId, result.RaidEncounterMode, result.RaidEncounterPlayers,
+		result.CombatStart.UTC().Format(time.RFC3339Nano), result.CombatEnd.UTC().Format(time.RFC3339Nano), result.Duration.Seconds(),
+		result.DamageOut, result.DamageIn, result.HealOut, result.EffectiveHealOut, result.HealIn, result.Threat, dps, hps, ehps,
+		result.RaidUserId, result.CombatTicks, flags)
+}
+
+// Distribution summarizes the server's unflagged results for an encounter
+func (s *Store) Distribution(key EncounterKey) (Distribution, error) {
+	var d Distribution
+	var dpsSquares, hpsSquares float64
+	err := s.distributionStmt.QueryRow(key.RaidEncounterId, key.RaidEncounterMode, key.RaidEncounterPlayers).Scan(&d.Count,
+		&d.MeanDPS, &dpsSquares, &d.MeanHPS, &hpsSquares)
+	if err != nil {
+		return d, err
+	}
+	d.StdDevDPS = math.Sqrt(math.Max(dpsSquares-d.MeanDPS*d.MeanDPS, 0))
+	d.StdDevHPS = math.Sqrt(math.Max(hpsSquares-d.MeanHPS*d.MeanHPS, 0))
+	return d, nil
+}
+
+// FightDamage returns the total damage recorded by a group's members for the
+// fight that started at combatStart
+func (s *Store) FightDamage(groupId uint32, key EncounterKey, combatStart time.Time) (int64, error) {
+	from, to := fightWindow(combatStart)
+	var damage int64
+	err := s.fightDamageStmt.QueryRow(groupId, key.RaidEncounterId, key.RaidEncounterMode, key.RaidEncounterPlayers,
+		from, to).Scan(&damage)
+	return damage, err
+}
+
+// FlagFight flags every result recorded by a group's members for the fight
+// that started at combatStart, returning how many were newly flagged
+func (s *Store) FlagFight(groupId uint32, key EncounterKey, combatStart time.Time, flag string) (int64, error) {
+	from, to := fightWindow(combatStart)
+	result, err := s.flagFightStmt.Exec(groupId, key.RaidEncounterId, key.RaidEncounterMode, key.RaidEncounterPlayers,
+		from, to, flag)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func fightWindow(combatStart time.Time) (string, string) {
+	combatStart = combatStart.UTC()
+	return combatStart.Add(-FightWindow).Format(rangeFormat), combatStart.Add(FightWindow).Format(rangeFormat)
+}
+
+// Top returns the best limit players for an encounter by the given metric,
+// across the whole server if groupId is 0
+func (s *Store) Top(key EncounterKey, metric string, groupId uint32, limit int) ([]Entry, error) {
+	stmt := s.topStmts[metric]
+	if stmt == nil {
+		return nil, ErrUnknownMetric
+	}
+
+	rows, err := stmt.Query(key.RaidEncounterId, key.RaidEncounterMode, key.RaidEncounterPlayers, groupId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]Entry, 0, limit)
+	for rows.Next() {
+		entry := Entry{Rank: len(entries) + 1}
+		err = rows.Scan(&entry.GroupId, &entry.CharacterName, &entry.Value, &entry.Duration, &entry.CombatStart)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// PersonalBests returns a character's best rates for every encounter they've
+// done with a raid group
+func (s *Store) PersonalBests(groupId uint32, character string) ([]PersonalBest, error) {
+	rows, err := s.personalBestsStmt.Query(groupId, character)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bests := make([]PersonalBest, 0, 16)
+	for rows.Next() {
+		var best PersonalBest
+		err = rows.Scan(&best.RaidEncounterId, &best.RaidEncounterMode, &best.RaidEncounterPlayers, &best.Encounters,
+			&best.DPS, &best.HPS, &best.EHPS)
+		if err != nil {
+			return nil, err
+		}
+		bests = append(bests, best)
+	}
+	return bests, rows.Err()
+}
+
+// Each calls fn for every result matching the filter, in order of combat
+// start, without loading them all into memory
+func (s *Store) Each(filter Filter, fn func(Result) error) error {
+	from := ""
+	if !filter.From.IsZero() {
+		from = filter.From.UTC().Format(rangeFormat)
+	}
+	to := "9999"
+	if !filter.To.IsZero() {
+		to = filter.To.UTC().Format(rangeFormat)
+	}
+
+	rows, err := s.resultsStmt.Query(filter.GroupId, from, to, filter.Encounter.RaidEncounterId,
+		filter.Encounter.RaidEncounterMode, filter.Encounter.RaidEncounterPlayers)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result Result
+		var combatStart, combatEnd, flags string
+		var duration float64
+		err = rows.Scan(&result.RaidUserId, &result.CharacterName, &result.RaidEncounterId, &result.RaidEncounterMode,
+			&result.RaidEncounterPlayers, &combatStart, &combatEnd, &duration, &result.CombatTicks, &result.DamageOut,
+			&result.DamageIn, &result.HealOut, &result.EffectiveHealOut, &result.HealIn, &result.Threat, &flags)
+		if err != nil {
+			return err
+		}
+		if flags != "" {
+			result.Flags = strings.Split(flags, ",")
+		}
+		result.CombatStart, _ = time.Parse(time.RFC3339Nano, combatStart)
+		result.CombatEnd, _ = time.Parse(time.RFC3339Nano, combatEnd)
+		result.Duration = time.Duration(duration * float64(time.Second))
+
+		err = fn(result)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,184 @@
+// Package migrations evolves the raid group database schema shared by both
+// servers. Migrations are numbered SQL files embedded from sql/, applied in
+// order, each in its own transaction, and recorded in schema_migrations so
+// they only ever run once.
+package migrations
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tableCreate = `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY NOT NULL,
+		name TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`
+	selectApplied = "SELECT version, applied_at FROM schema_migrations"
+	insertApplied = "INSERT INTO schema_migrations VALUES (?, ?, ?)"
+	selectTable   = "SELECT count(*) FROM sqlite_master WHERE type='table' AND name=?"
+)
+
+//go:embed sql/*.up.sql
+var files embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+type Status struct {
+	Version   int
+	Name      string
+	AppliedAt string // Empty if pending
+}
+
+// All returns the embedded migrations in order
+func All() ([]Migration, error) {
+	entries, err := files.ReadDir("sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(entries))
+	for _, entry := range entries {
+		// Files are named like 0001_raid_groups.up.sql
+		name := strings.TrimSuffix(entry.Name(), ".up.sql")
+		i := strings.IndexByte(name, '_')
+		if i < 0 {
+			return nil, fmt.Errorf("migrations: bad file name %q", entry.Name())
+		}
+		version, err := strconv.Atoi(name[:i])
+		if err != nil {
+			return nil, fmt.Errorf("migrations: bad file name %q", entry.Name())
+		}
+		data, err := files.ReadFile(path.Join("sql", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name[i+1:], SQL: string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("migrations: duplicate version %d", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// Migrate applies every pending migration, returning the ones it applied
+func Migrate(db *sql.DB) ([]Migration, error) {
+	migrations, err := All()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := load(db)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make([]Migration, 0, len(migrations))
+	for _, m := range migrations {
+		if applied[m.Version] != "" {
+			continue
+		}
+		err = apply(db, m)
+		if err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// Statuses reports which migrations have been applied, without changing the
+// database
+func Statuses(db *sql.DB) ([]Status, error) {
+	migrations, err := All()
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]string{}
+	exists, err := tableExists(db, "schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		applied, err = loadApplied(db)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]Status, len(migrations))
+	for i, m := range migrations {
+		statuses[i] = Status{Version: m.Version, Name: m.Name, AppliedAt: applied[m.Version]}
+	}
+	return statuses, nil
+}
+
+func apply(db *sql.DB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(m.SQL)
+	if err == nil {
+		_, err = tx.Exec(insertApplied, m.Version, m.Name, now())
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+	}
+	return tx.Commit()
+}
+
+// Loads when each migration was applied, creating the tracking table if
+// needed
+func load(db *sql.DB) (map[int]string, error) {
+	_, err := db.Exec(tableCreate)
+	if err != nil {
+		return nil, err
+	}
+	return loadApplied(db)
+}
+
+func tableExists(db *sql.DB, table string) (bool, error) {
+	var count int
+	err := db.QueryRow(selectTable, table).Scan(&count)
+	return count > 0, err
+}
+
+func loadApplied(db *sql.DB) (map[int]string, error) {
+	rows, err := db.Query(selectApplied)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]string{}
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,189 @@
+package migrations
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func exec(t *testing.T, db *sql.DB, query string) {
+	if _, err := db.Exec(query); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+func hasTable(t *testing.T, db *sql.DB, table string) bool {
+	exists, err := tableExists(db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+func versions(migrations []Migration) []int {
+	v := make([]int, len(migrations))
+	for i, m := range migrations {
+		v[i] = m.Version
+	}
+	return v
+}
+
+func TestAll(t *testing.T) {
+	migrations, err := All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d (%s) is out of sequence", m.Version, m.Name)
+		}
+		if m.SQL == "" {
+			t.Errorf("migration %d (%s) is empty", m.Version, m.Name)
+		}
+	}
+}
+
+func TestMigrateEmpty(t *testing.T) {
+	db := openDB(t)
+	all, _ := All()
+
+	applied, err := Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(all) {
+		t.Fatalf("applied %v, want all %d", versions(applied), len(all))
+	}
+	for _, table := range []string{"raid_groups", "encounter_results", "catalog_encounters", "catalog_modes", "catalog_health", "raid_group_webhooks"} {
+		if !hasTable(t, db, table) {
+			t.Errorf("%s wasn't created", table)
+		}
+	}
+
+	// Nothing is left to apply the second time
+	applied, err = Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("applied %v again", versions(applied))
+	}
+	statuses, err := Statuses(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt == "" {
+			t.Errorf("migration %d applied at %q", status.Version, status.AppliedAt)
+		}
+	}
+}
+
+// A database from before migrations, with only the raid_groups table both
+// servers originally created
+func baselineDB(t *testing.T) *sql.DB {
+	db := openDB(t)
+	exec(t, db, "CREATE TABLE IF NOT EXISTS raid_groups (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL UNIQUE, name TEXT NOT NULL UNIQUE, password TEXT, admin_password TEXT, datetime TEXT);")
+	exec(t, db, "INSERT INTO raid_groups (name, password, admin_password, datetime) VALUES ('Baseline', 'pw', 'admin', '2024-01-01T00:00:00Z')")
+	return db
+}
+
+// Returns the columns of every table and the SQL of every index, keyed by name
+func schema(t *testing.T, db *sql.DB) map[string]string {
+	rows, err := db.Query(`SELECT m.name, group_concat(c.name || ' ' || c.type || ' ' || c."notnull" || ' ' || ifnull(c.dflt_value, '') || ' ' || c.pk, ', ')
+		FROM sqlite_master AS m, pragma_table_info(m.name) AS c
+		WHERE m.type='table' AND m.name NOT IN ('schema_migrations', 'sqlite_sequence') GROUP BY m.name
+		UNION ALL SELECT name, sql FROM sqlite_master WHERE type='index' AND sql IS NOT NULL`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	schema := map[string]string{}
+	for rows.Next() {
+		var name, definition string
+		if err := rows.Scan(&name, &definition); err != nil {
+			t.Fatal(err)
+		}
+		schema[name] = definition
+	}
+	return schema
+}
+
+func TestStatusesBaseline(t *testing.T) {
+	db := baselineDB(t)
+
+	statuses, err := Statuses(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt != "" {
+			t.Errorf("migration %d applied at %q, want pending", status.Version, status.AppliedAt)
+		}
+	}
+
+	// Reporting doesn't touch the database
+	if hasTable(t, db, "schema_migrations") {
+		t.Error("Statuses created schema_migrations")
+	}
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	db := baselineDB(t)
+	all, _ := All()
+
+	applied, err := Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(all) {
+		t.Fatalf("applied %v, want all %d", versions(applied), len(all))
+	}
+	applied, err = Migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("applied %v again", versions(applied))
+	}
+
+	// Existing groups are kept, and get a full expiry period from the migration
+	var name, lastUsed, status string
+	err = db.QueryRow("SELECT name, last_used, status FROM raid_groups WHERE id=1").Scan(&name, &lastUsed, &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "Baseline" || lastUsed == "2024-01-01T00:00:00Z" || lastUsed == "" || status != "active" {
+		t.Errorf("baseline group = %q, %q, %q", name, lastUsed, status)
+	}
+
+	// The migrations alone describe the schema, whether the database started
+	// empty or at the baseline
+	empty := openDB(t)
+	if _, err := Migrate(empty); err != nil {
+		t.Fatal(err)
+	}
+	want := schema(t, empty)
+	got := schema(t, db)
+	for name, definition := range want {
+		if got[name] != definition {
+			t.Errorf("%s = %q, want %q", name, got[name], definition)
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			t.Errorf("unexpected %s", name)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+-- Raid groups, as originally created by both servers, so databases from
+-- before migrations already have it
+CREATE TABLE IF NOT EXISTS raid_groups (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL UNIQUE,
+	name TEXT NOT NULL UNIQUE,
+	password TEXT,
+	admin_password TEXT,
+	datetime TEXT
+);
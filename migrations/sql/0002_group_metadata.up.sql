@@ -0,0 +1,7 @@
+-- Group metadata and lifecycle. The existing datetime column is when the group
+-- was created, not when it was last used, so existing groups get a full expiry
+-- period from when this migration runs.
+ALTER TABLE raid_groups ADD COLUMN last_used TEXT;
+ALTER TABLE raid_groups ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE raid_groups ADD COLUMN owner_contact TEXT NOT NULL DEFAULT '';
+UPDATE raid_groups SET last_used=strftime('%Y-%m-%dT%H:%M:%SZ', 'now');
@@ -0,0 +1,19 @@
+-- Roles, spectator invites and bans managed by group admins
+CREATE TABLE raid_group_roles (
+	group_id INTEGER NOT NULL,
+	character_name TEXT NOT NULL,
+	role TEXT NOT NULL,
+	PRIMARY KEY (group_id, character_name)
+);
+CREATE TABLE raid_group_invites (
+	code TEXT PRIMARY KEY NOT NULL,
+	group_id INTEGER NOT NULL,
+	datetime TEXT
+);
+CREATE TABLE raid_group_bans (
+	group_id INTEGER NOT NULL,
+	character_name TEXT NOT NULL,
+	raid_user_id INTEGER NOT NULL,
+	datetime TEXT,
+	UNIQUE (group_id, character_name, raid_user_id)
+);
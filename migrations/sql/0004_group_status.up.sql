@@ -0,0 +1,3 @@
+-- Groups can be locked by the server operator, or wait for their approval
+-- after being created. Only active groups can be logged into.
+ALTER TABLE raid_groups ADD COLUMN status TEXT NOT NULL DEFAULT 'active';
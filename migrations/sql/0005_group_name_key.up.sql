@@ -0,0 +1,5 @@
+-- Normalized group names, so look-alike names can't be registered twice.
+-- Existing groups get their key when the server starts, which reports any
+-- that collide and leaves them without one.
+ALTER TABLE raid_groups ADD COLUMN name_key TEXT;
+CREATE UNIQUE INDEX raid_groups_name_key ON raid_groups (name_key);
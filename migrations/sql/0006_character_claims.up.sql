@@ -0,0 +1,10 @@
+-- Characters claimed by a player with a personal secret, so only they can
+-- report stats as that character within the group. Secrets are bcrypt hashed.
+CREATE TABLE raid_group_characters (
+	group_id INTEGER NOT NULL,
+	character_key TEXT NOT NULL,
+	character_name TEXT NOT NULL,
+	secret_hash TEXT NOT NULL,
+	datetime TEXT NOT NULL,
+	PRIMARY KEY (group_id, character_key)
+);
@@ -0,0 +1,26 @@
+-- URLs a group's admin has registered to be notified of raid events, and a
+-- log of every delivery to them. Events is a comma separated list, or empty
+-- for every event.
+CREATE TABLE raid_group_webhooks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	group_id INTEGER NOT NULL,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	events TEXT NOT NULL DEFAULT '',
+	datetime TEXT NOT NULL
+);
+CREATE INDEX raid_group_webhooks_group ON raid_group_webhooks (group_id);
+
+CREATE TABLE webhook_deliveries (
+	id TEXT PRIMARY KEY NOT NULL,
+	webhook_id INTEGER NOT NULL,
+	group_id INTEGER NOT NULL,
+	event TEXT NOT NULL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	response_code INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	created TEXT NOT NULL,
+	updated TEXT NOT NULL
+);
+CREATE INDEX webhook_deliveries_group ON webhook_deliveries (group_id, created);
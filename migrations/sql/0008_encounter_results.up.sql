@@ -0,0 +1,27 @@
+-- Finished encounters, for leaderboards, personal bests and exports
+CREATE TABLE encounter_results (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL UNIQUE,
+	group_id INTEGER NOT NULL,
+	character_name TEXT NOT NULL,
+	raid_encounter_id INTEGER NOT NULL,
+	raid_encounter_mode INTEGER NOT NULL,
+	raid_encounter_players INTEGER NOT NULL,
+	combat_start TEXT NOT NULL,
+	combat_end TEXT NOT NULL,
+	duration REAL NOT NULL,
+	damage_out INTEGER NOT NULL,
+	damage_in INTEGER NOT NULL,
+	heal_out INTEGER NOT NULL,
+	effective_heal_out INTEGER NOT NULL,
+	heal_in INTEGER NOT NULL,
+	threat INTEGER NOT NULL,
+	dps REAL NOT NULL,
+	hps REAL NOT NULL,
+	ehps REAL NOT NULL,
+	raid_user_id INTEGER NOT NULL DEFAULT 0,
+	combat_ticks INTEGER NOT NULL DEFAULT 0,
+	UNIQUE (group_id, character_name, combat_start)
+);
+CREATE INDEX encounter_results_encounter ON encounter_results (raid_encounter_id, raid_encounter_mode, raid_encounter_players);
+CREATE INDEX encounter_results_character ON encounter_results (group_id, character_name);
+CREATE INDEX encounter_results_group_start ON encounter_results (group_id, combat_start);
@@ -0,0 +1,11 @@
+-- Encounter and mode names saved over the bundled catalog
+CREATE TABLE catalog_encounters (
+	id INTEGER PRIMARY KEY NOT NULL,
+	operation TEXT NOT NULL,
+	boss TEXT NOT NULL
+);
+CREATE TABLE catalog_modes (
+	id INTEGER PRIMARY KEY NOT NULL,
+	difficulty TEXT NOT NULL,
+	players INTEGER NOT NULL
+);
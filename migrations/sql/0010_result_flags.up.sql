@@ -0,0 +1,9 @@
+-- Why a finished encounter was judged implausible, as a comma separated list,
+-- and boss health to judge damage against
+ALTER TABLE encounter_results ADD COLUMN flags TEXT NOT NULL DEFAULT '';
+CREATE TABLE catalog_health (
+	encounter_id INTEGER NOT NULL,
+	mode_id INTEGER NOT NULL,
+	health INTEGER NOT NULL,
+	PRIMARY KEY (encounter_id, mode_id)
+);
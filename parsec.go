@@ -7,10 +7,19 @@ import (
 	"runtime"
 	"time"
 	"sync"
+	"strings"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"database/sql"
-	"github.com/youtube/vitess/go/cgzip"
+	"github.com/warhammerkid/parsec-go/compression"
+	"github.com/warhammerkid/parsec-go/groupname"
+	"github.com/warhammerkid/parsec-go/identity"
+	"github.com/warhammerkid/parsec-go/migrations"
+	"github.com/warhammerkid/parsec-go/polling"
+	"github.com/warhammerkid/parsec-go/stats"
+	"github.com/warhammerkid/parsec-go/webhook"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -20,12 +29,12 @@ type RaidUser struct {
 	LastConnectDate       string `json:"LastConnectDate" sync_type:"server"`
 	IsConnected           bool `json:"IsConnected" sync_type:"server"`
 	CharacterName         string `json:"CharacterName" sync_type:"client-static"`
-	DamageOut             int32 `json:"DamageOut" sync_type:"client"`
-	DamageIn              int32 `json:"DamageIn" sync_type:"client"`
-	HealOut               int32 `json:"HealOut" sync_type:"client"`
-	EffectiveHealOut      int32 `json:"EffectiveHealOut" sync_type:"client"`
-	HealIn                int32 `json:"HealIn" sync_type:"client"`
-	Threat                int32 `json:"Threat" sync_type:"client"`
+	DamageOut             stats.Counter `json:"DamageOut" sync_type:"client"`
+	DamageIn              stats.Counter `json:"DamageIn" sync_type:"client"`
+	HealOut               stats.Counter `json:"HealOut" sync_type:"client"`
+	EffectiveHealOut      stats.Counter `json:"EffectiveHealOut" sync_type:"client"`
+	HealIn                stats.Counter `json:"HealIn" sync_type:"client"`
+	Threat                stats.Counter `json:"Threat" sync_type:"client"`
 	RaidEncounterId       int32 `json:"RaidEncounterId" sync_type:"client"`
 	RaidEncounterMode     int32 `json:"RaidEncounterMode" sync_type:"client"`
 	RaidEncounterPlayers  int32 `json:"RaidEncounterPlayers" sync_type:"client"`
@@ -63,9 +72,14 @@ type DeleteRequest struct {
 	AdminPassword         string `json:"adminPassword"`
 }
 
+type GroupEvent struct {
+	Reason                string // admin
+}
+
 type SyncOrGetRequest struct {
 	RaidGroup             string
 	RaidPassword          string
+	CharacterSecret       string // Needed to sync a claimed character, or claims an unclaimed one
 	Statistics            RaidUser
 }
 
@@ -77,10 +91,14 @@ type SyncOrGetResponse struct {
 
 const (
 	// Database
-	tableCreate = "CREATE TABLE IF NOT EXISTS raid_groups (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL UNIQUE, name TEXT NOT NULL UNIQUE, password TEXT, admin_password TEXT, datetime TEXT);"
-	createRaidGroup = "INSERT INTO raid_groups VALUES (NULL, ?, ?, ?, ?)"
-	deleteRaidGroup = "DELETE FROM raid_groups WHERE name=? AND admin_password=?"
-	loginSelect     = "SELECT id, password FROM raid_groups WHERE name=?"
+	createRaidGroup = "INSERT INTO raid_groups (name, name_key, password, admin_password, datetime, last_used, status) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	updateRaidGroupUsed = "UPDATE raid_groups SET last_used=? WHERE id=?"
+	matchRaidGroupName = "id=(SELECT id FROM raid_groups WHERE name_key=?1 OR (name_key IS NULL AND name=?2) ORDER BY name=?2 DESC LIMIT 1)" // Normalized name, or exact name if it collided
+	selectRaidGroupAdmin = "SELECT id, name FROM raid_groups WHERE " + matchRaidGroupName + " AND admin_password=?3"
+	loginSelect     = "SELECT id, password FROM raid_groups WHERE " + matchRaidGroupName + " AND status='active'"
+
+	// Largest request body accepted, after decompression
+	maxRequestBodySize = 64 * 1024
 
 	// Paths
 	requestRaidGroupPath = "/api/RequestRaidGroup"
@@ -92,34 +110,72 @@ const (
 
 var (
 	// Database
+	db                  *sql.DB
 	createRaidGroupStmt *sql.Stmt
-	deleteRaidGroupStmt *sql.Stmt
+	selectRaidGroupAdminStmt *sql.Stmt
 	loginStmt           *sql.Stmt
+	updateRaidGroupUsedStmt *sql.Stmt
 
 	// Stats
 	allRaidStats        *RaidStatsCache
+
+	// Polling rate limits
+	pollLimiter         *polling.Limiter
+
+	// Characters claimed by players
+	identities          *identity.Store
+
+	// Webhook deliveries
+	webhooks            *webhook.Dispatcher
+
+	// New groups need the server operator's approval before they can be used
+	requireApproval     bool
 )
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	// Open database
-	db, err := sql.Open("sqlite3", "./raid_groups.db")
+	dbPath := os.Getenv("DATABASE_PATH")
+	if dbPath == "" {
+		dbPath = "./raid_groups.db"
+	}
+	var err error
+	db, err = sql.Open("sqlite3", dbPath)
 	if err != nil {
 		log.Fatalf("Error opening database: %v", err)
 	}
 	defer db.Close()
 
-	// Prepare SQL queries
-	_, err = db.Exec(tableCreate)
+	// Bring the schema up to date
+	applied, err := migrations.Migrate(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, m := range applied {
+		log.Printf("Applied schema migration %d: %s", m.Version, m.Name)
+	}
+	collisions, err := groupname.Backfill(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range collisions {
+		log.Printf("Raid group name collision: '%s' (%d) normalizes to the same name as '%s' (%d)", c.Name, c.Id, c.ConflictName, c.ConflictId)
+	}
+	claimCollisions, err := identity.Rekey(db)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, c := range claimCollisions {
+		log.Printf("Character claim collision: '%s' in raid group %d normalizes to the same name as '%s', so its claim was dropped", c.CharacterName, c.GroupId, c.ConflictName)
+	}
+
+	// Prepare SQL queries
 	createRaidGroupStmt, err = db.Prepare(createRaidGroup)
 	if err != nil {
 		log.Fatal(err)
 	}
-	deleteRaidGroupStmt, err = db.Prepare(deleteRaidGroup)
+	selectRaidGroupAdminStmt, err = db.Prepare(selectRaidGroupAdmin)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -127,9 +183,25 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	updateRaidGroupUsedStmt, err = db.Prepare(updateRaidGroupUsed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	identities, err = identity.NewStore(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhooks, err = webhook.NewDispatcher(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhooks.AllowPrivate = os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
 
 	// Initialize in-memory stores
 	allRaidStats = &RaidStatsCache{Raids:map[uint32]*RaidStats{}}
+	pollLimiter = polling.NewLimiter()
+
+	requireApproval = os.Getenv("GROUP_APPROVAL") == "true"
 
 	// Start up raid GC
 	go garbageCollectRaidStats()
@@ -159,28 +231,41 @@ func homepageHandler(w http.ResponseWriter, r *http.Request) {
 func requestRaidGroupHandler(w http.ResponseWriter, r *http.Request) {
 	// Set up http response and defer writing output
 	res := ActionResponse{false, "An unknown error was encountered"}
-	defer sendSerializedJSON(w, &res)
+	defer sendSerializedJSON(w, r, &res)
 
 	// Parse and validate request
 	var req CreateRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		res.Message = "Invalid JSON"
+	if message := decodeRequest(w, r, &req); message != "" {
+		res.Message = message
 		return
 	}
 	if req.RequestedName == "" || req.RequestedPassword == "" || req.AdminPassword == "" {
 		res.Message = "Empty paramaters - all fields required"
 		return
 	}
+	name, nameKey, err := groupname.Validate(req.RequestedName)
+	if err != nil {
+		res.Message = err.Error()
+		return
+	}
 
-	// Insert into the database
-	qres, _ := createRaidGroupStmt.Exec(req.RequestedName, req.RequestedPassword, req.AdminPassword, time.Now().Format(time.RFC3339))
+	// Insert into the database, waiting for the operator to approve it if
+	// they've asked to
+	status := "active"
+	if requireApproval {
+		status = "pending"
+	}
+	now := time.Now().Format(time.RFC3339)
+	qres, _ := createRaidGroupStmt.Exec(name, nameKey, req.RequestedPassword, req.AdminPassword, now, now, status)
 	if qres != nil {
 		affected, _ := qres.RowsAffected()
 		if affected == 1 {
-			log.Printf("Created raid group: '%s'", req.RequestedName)
+			log.Printf("Created raid group: '%s' (%s)", name, status)
 			res.Success = true
 			res.Message = "Raid group created successfully"
+			if requireApproval {
+				res.Message = "Raid group created, waiting for approval"
+			}
 		}
 	} else {
 		res.Message = "A group with the given name already exists"
@@ -190,38 +275,45 @@ func requestRaidGroupHandler(w http.ResponseWriter, r *http.Request) {
 func deleteRaidGroupHandler(w http.ResponseWriter, r *http.Request) {
 	// Set up http response and defer writing output
 	res := ActionResponse{false, "An unknown error was encountered"}
-	defer sendSerializedJSON(w, &res)
+	defer sendSerializedJSON(w, r, &res)
 
 	// Parse request
 	var req DeleteRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		res.Message = "Invalid JSON"
+	if message := decodeRequest(w, r, &req); message != "" {
+		res.Message = message
 		return
 	}
 
-	// Perform delete
-	qres, _ := deleteRaidGroupStmt.Exec(req.GroupName, req.AdminPassword)
-	if qres != nil {
-		affected, _ := qres.RowsAffected()
-		if affected == 1 {
-			log.Printf("Deleted raid group: '%s'", req.GroupName)
-			res.Success = true
-			res.Message = "Raid group deleted successfully"
-		}
+	// Perform delete, removing everything belonging to the group
+	var groupId uint32
+	var name string
+	selectRaidGroupAdminStmt.QueryRow(groupname.Key(req.GroupName), req.GroupName, req.AdminPassword).Scan(&groupId, &name)
+	if groupId == 0 {
+		return
+	}
+	err := groupname.Delete(db, groupId)
+	if err != nil {
+		log.Printf("Error deleting raid group: %v", err)
+		return
 	}
+	allRaidStats.Lock()
+	delete(allRaidStats.Raids, groupId)
+	allRaidStats.Unlock()
+	log.Printf("Deleted raid group: '%s'", name)
+	webhooks.Send(groupId, name, webhook.GroupDeleted, GroupEvent{Reason:"admin"})
+	res.Success = true
+	res.Message = "Raid group deleted successfully"
 }
 
 func testConnectionHandler(w http.ResponseWriter, r *http.Request) {
 	// Set up http response and defer writing output
 	res := SyncOrGetResponse{ErrorMessage:"Connection failed"}
-	defer sendSerializedJSON(w, &res)
+	defer sendSerializedJSON(w, r, &res)
 
 	// Parse request
 	var req SyncOrGetRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		res.ErrorMessage = "Invalid JSON"
+	if message := decodeRequest(w, r, &req); message != "" {
+		res.ErrorMessage = message
 		return
 	}
 
@@ -235,13 +327,12 @@ func testConnectionHandler(w http.ResponseWriter, r *http.Request) {
 func syncOrGetStatsHandler(w http.ResponseWriter, r *http.Request) {
 	// Set up http response and defer writing output
 	res := SyncOrGetResponse{ErrorMessage:"An unknown error was encountered"}
-	defer sendSerializedJSON(w, &res)
+	defer sendSerializedJSON(w, r, &res)
 
 	// Parse request
 	var req SyncOrGetRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		res.ErrorMessage = "Invalid JSON"
+	if message := decodeRequest(w, r, &req); message != "" {
+		res.ErrorMessage = message
 		return
 	}
 
@@ -254,19 +345,43 @@ func syncOrGetStatsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Save stats
 	if r.URL.Path == syncRaidStatsPath {
-		updateRaidStats(raidStats, req.Statistics)
+		userStats, err := raidUserStats(&req.Statistics)
+		if err == nil {
+			err = userStats.Validate(time.Now())
+		}
+		if err != nil {
+			res.ErrorMessage = "Invalid Statistics: " + err.Error()
+			return
+		}
+		if message := verifyCharacter(raidStats, req.Statistics.CharacterName, req.CharacterSecret); message != "" {
+			res.ErrorMessage = message
+			return
+		}
+		if !updateRaidStats(raidStats, req.Statistics) {
+			res.ErrorMessage = "RaidUserId belongs to a claimed character"
+			return
+		}
+	}
+
+	// Throttle clients polling faster than their group's advertised rate.
+	// Synced stats have already been saved, so only the group's are withheld.
+	res.MinimumPollingRate = raidStatsPollingRate(raidStats)
+	client := fmt.Sprintf("%d/%d/%s", raidStats.GroupId, req.Statistics.RaidUserId, remoteHost(r))
+	allowed, _ := pollLimiter.Allow(client, res.MinimumPollingRate)
+	if !allowed {
+		res.ErrorMessage = "Polling too frequently"
+		return
 	}
 
 	// Prepare response
 	res.ErrorMessage = ""
 	res.Users = raidStats.Users
-	res.MinimumPollingRate = 1
 }
 
 func loginRaid(group string, password string) uint32 {
 	var id uint32
 	var groupPassword string
-	loginStmt.QueryRow(group).Scan(&id, &groupPassword)
+	loginStmt.QueryRow(groupname.Key(group), group).Scan(&id, &groupPassword)
 	if password == groupPassword {
 		return id
 	} else {
@@ -289,6 +404,7 @@ func loginRaidStats(group string, password string) *RaidStats {
 		raidStats.LastActivity = time.Now()
 	} else {
 		log.Printf("Creating raid stats collection for: %s (%d)", group, groupId)
+		updateRaidGroupUsedStmt.Exec(time.Now().Format(time.RFC3339), groupId)
 		users := make([]*RaidUser, 0, 8)
 		raidStats = &RaidStats{groupId, group, users, time.Now()}
 		allRaidStats.Lock()
@@ -299,7 +415,40 @@ func loginRaidStats(group string, password string) *RaidStats {
 	return raidStats
 }
 
-func updateRaidStats(raidStats *RaidStats, parsedUser RaidUser) {
+// Checks that the client can sync as the character, returning an error
+// message for them if not. A secret for an unclaimed character claims it.
+func verifyCharacter(raidStats *RaidStats, character string, secret string) string {
+	if character == "" {
+		return ""
+	}
+	claimed, err := identities.Verify(raidStats.GroupId, character, secret)
+	if err == identity.ErrWrongSecret {
+		if secret == "" {
+			return "Character has been claimed, CharacterSecret required"
+		}
+		return "Invalid CharacterSecret"
+	} else if err != nil {
+		log.Printf("Error verifying character: %v", err)
+		return "Error verifying character"
+	}
+	if !claimed && secret != "" {
+		err = identities.Claim(raidStats.GroupId, character, secret)
+		if err == identity.ErrSecretLength {
+			return err.Error()
+		} else if err == identity.ErrAlreadyClaimed {
+			return "Invalid CharacterSecret"
+		} else if err != nil {
+			log.Printf("Error claiming character: %v", err)
+			return "Error claiming character"
+		}
+		log.Printf("Character claimed: %s in %s", character, raidStats.GroupName)
+	}
+	return ""
+}
+
+// Updates the user's stats, returning false if their RaidUserId is already in
+// use by a different character that has been claimed
+func updateRaidStats(raidStats *RaidStats, parsedUser RaidUser) bool {
 	nowString := time.Now().UTC().Format(time.RFC3339)
 
 	// Update existing user or create new one
@@ -307,6 +456,23 @@ func updateRaidStats(raidStats *RaidStats, parsedUser RaidUser) {
 	for i := 0; i < len(raidStats.Users); i++ {
 		if raidStats.Users[i].RaidUserId == parsedUser.RaidUserId {
 			user = raidStats.Users[i]
+
+			// The client's character was verified, but the one it's replacing
+			// may belong to someone else
+			if identity.Key(user.CharacterName) != identity.Key(parsedUser.CharacterName) {
+				claimed, err := identities.Claimed(raidStats.GroupId, user.CharacterName)
+				if claimed || err != nil {
+					return false
+				}
+			}
+
+			// Totals only go down mid-encounter if the client reset its meters
+			previous, _ := raidUserStats(user)
+			current, _ := raidUserStats(&parsedUser)
+			if decreased := stats.Decreased(&previous, &current); len(decreased) > 0 {
+				log.Printf("Stats reset for %s in %s: %s decreased", user.CharacterName, raidStats.GroupName, strings.Join(decreased, ", "))
+			}
+
 			user.DamageOut            = parsedUser.DamageOut
 			user.DamageIn             = parsedUser.DamageIn
 			user.HealOut              = parsedUser.HealOut
@@ -332,14 +498,94 @@ func updateRaidStats(raidStats *RaidStats, parsedUser RaidUser) {
 	user.LastConnectDate  = nowString
 	user.IsConnected      = true
 	user.LastCombatUpdate = nowString
+	return true
+}
+
+// Converts v1 stats so they can be checked like v2 stats. Clients send times
+// either with an offset or without one, in which case they're taken as UTC.
+func raidUserStats(u *RaidUser) (stats.UserStats, error) {
+	s := stats.UserStats{
+		RaidUserId:u.RaidUserId,
+		CharacterName:u.CharacterName,
+		DamageOut:int64(u.DamageOut),
+		DamageIn:int64(u.DamageIn),
+		HealOut:int64(u.HealOut),
+		EffectiveHealOut:int64(u.EffectiveHealOut),
+		HealIn:int64(u.HealIn),
+		Threat:int64(u.Threat),
+		RaidEncounterId:u.RaidEncounterId,
+		RaidEncounterMode:u.RaidEncounterMode,
+		RaidEncounterPlayers:u.RaidEncounterPlayers,
+		CombatTicks:u.CombatTicks,
+	}
+	var err error
+	s.CombatStart.Time, err = parseClientTime(u.CombatStart)
+	if err != nil {
+		return s, &stats.FieldError{Field:"CombatStart", Message:"is not a valid time"}
+	}
+	s.CombatEnd.Time, err = parseClientTime(u.CombatEnd)
+	if err != nil {
+		return s, &stats.FieldError{Field:"CombatEnd", Message:"is not a valid time"}
+	}
+	return s, nil
+}
+
+func parseClientTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		t, err = time.Parse("2006-01-02T15:04:05.999999999", value)
+	}
+	return t, err
+}
+
+func raidStatsPollingRate(raidStats *RaidStats) uint32 {
+	now := time.Now()
+	inCombat := false
+	for i := 0; i < len(raidStats.Users); i++ {
+		start, _ := parseClientTime(raidStats.Users[i].CombatStart)
+		end, _ := parseClientTime(raidStats.Users[i].CombatEnd)
+		if polling.InCombat(start, end, now) {
+			inCombat = true
+			break
+		}
+	}
+	return pollLimiter.Rate(len(raidStats.Users), inCombat)
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Decodes a JSON request body, returning a message for the client if it's
+// too large or isn't valid
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) string {
+	// Bodies can be gzipped, like in v2. The size limit applies after
+	// decompression.
+	err := compression.DecodeRequestBody(r)
+	if err != nil {
+		return "Unsupported Content-Encoding"
+	}
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodySize)).Decode(v)
+	if err == nil {
+		return ""
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return "Request too large"
+	}
+	return "Invalid JSON: " + err.Error()
 }
 
-func sendSerializedJSON(w http.ResponseWriter, res interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Content-Encoding", "gzip")
-	gz, _ := cgzip.NewWriterLevel(w, 1)
-	json.NewEncoder(gz).Encode(&res)
-	gz.Close()
+func sendSerializedJSON(w http.ResponseWriter, r *http.Request, res interface{}) {
+	body, _ := json.Marshal(&res)
+	compression.Write(w, r, "application/json", body)
 }
 
 // Go through all raid groups and remove those that are inactive
@@ -362,6 +608,9 @@ func garbageCollectRaidStats() {
 		}
 		allRaidStats.RUnlock()
 
+		// Forget polling history for clients that have gone away
+		pollLimiter.Prune(5*time.Minute)
+
 		// Delete inactive groups
 		if len(inactiveGroupIds) > 0 {
 			log.Printf("Deleting inactive group ids: %v", inactiveGroupIds)
@@ -2,23 +2,46 @@ package main
 
 import (
 	"os"
+	"io"
 	"fmt"
+	"errors"
+	"flag"
+	"text/tabwriter"
+	"crypto/rand"
+	"encoding/base64"
 	"log"
 	"runtime"
 	"time"
 	"sync"
+	"strings"
+	"sort"
+	"strconv"
+	"io/ioutil"
 	"encoding/json"
+	"crypto/subtle"
+	"hash/crc32"
+	"net/url"
 	"net/http"
 	"database/sql"
 	"github.com/satori/go.uuid"
-	"github.com/youtube/vitess/go/cgzip"
+	"github.com/warhammerkid/parsec-go/anomaly"
+	"github.com/warhammerkid/parsec-go/catalog"
+	"github.com/warhammerkid/parsec-go/combatlog"
+	"github.com/warhammerkid/parsec-go/compression"
+	"github.com/warhammerkid/parsec-go/dashboard"
+	"github.com/warhammerkid/parsec-go/export"
+	"github.com/warhammerkid/parsec-go/groupname"
+	"github.com/warhammerkid/parsec-go/history"
+	"github.com/warhammerkid/parsec-go/identity"
+	"github.com/warhammerkid/parsec-go/leaderboard"
+	"github.com/warhammerkid/parsec-go/migrations"
+	"github.com/warhammerkid/parsec-go/polling"
+	"github.com/warhammerkid/parsec-go/roles"
+	"github.com/warhammerkid/parsec-go/stats"
+	"github.com/warhammerkid/parsec-go/webhook"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-type RFC3339NanoTime struct {
-	time.Time
-}
-
 type UserStore struct {
 	sync.RWMutex
 	users map[uuid.UUID]*User
@@ -26,27 +49,134 @@ type UserStore struct {
 
 type User struct {
     token uuid.UUID
+    connected time.Time
     lastActivity time.Time
     raidGroup *RaidGroup
-    stats UserStats
+    stats stats.UserStats
+    abilities stats.EncounterAbilities
+    history *history.Ring // Created when the user first reports stats
+    pendingEncounter *stats.UserStats // Latest stats for an encounter not yet recorded
+    resetStart time.Time // CombatStart of the last encounter the client reset its totals in
+    combatLog *combatlog.Aggregator // Set once the user starts sending their combat log
+    spectator bool // Read-only, and not listed as a group member
+    character string // Character the connection is bound to, if any
+    verified bool // Connected with the secret for a claimed character
+}
+
+type UserHistory struct {
+	RaidUserId            int32
+	CharacterName         string
+	CombatStart           stats.RFC3339NanoTime
+	Buckets               []history.Bucket
+}
+
+type LeaderboardResponse struct {
+	leaderboard.EncounterKey
+	catalog.Resolved
+	Metric                string
+	Entries               []leaderboard.Entry
+}
+
+type PersonalBestResponse struct {
+	leaderboard.PersonalBest
+	catalog.Resolved
+}
+
+type CombatLogResponse struct {
+	Parsed                int
+	Skipped               int
+	Stats                 stats.UserStats
+}
+
+type RaidGroupInfo struct {
+	Id                    uint32
+	Name                  string
+	Description           string
+	OwnerContact          string
+	Created               string
+	LastUsed              string
+	Status                string // active, locked or pending
+}
+
+// Everything about a group, for "parsec2 group show"
+type RaidGroupDetails struct {
+	RaidGroupInfo
+	Roles                 map[string]string
+	Invites               []Invite
+	Bans                  []Ban
 }
 
-type UserStats struct {
+// A group as the server operator sees it, including who's connected
+type OperatorGroup struct {
+	RaidGroupInfo
+	Members               int
+	Spectators            int
+}
+
+type Session struct {
+	GroupId               uint32
+	Group                 string
+	RaidUserId            int32
+	CharacterName         string
+	Spectator             bool
+	Connected             time.Time
+	LastActivity          time.Time
+}
+
+type ExpiredGroup struct {
+	Id                    uint32
+	Name                  string
+	LastUsed              string
+}
+
+type Member struct {
+	Id                    int // Position in the group, used to kick the member
 	RaidUserId            int32
 	CharacterName         string
-	DamageOut             int32
-	DamageIn              int32
-	HealOut               int32
-	EffectiveHealOut      int32
-	HealIn                int32
-	Threat                int32
-	RaidEncounterId       int32
-	RaidEncounterMode     int32
-	RaidEncounterPlayers  int32
-	CombatTicks           int64
-	CombatStart           RFC3339NanoTime
-	CombatEnd             RFC3339NanoTime
-	LastCombatUpdate      RFC3339NanoTime // Server provided
+	TokenAge              float64 // Seconds since connecting
+	LastActivity          time.Time
+	Verified              bool // Connected with the character's secret
+}
+
+type Ban struct {
+	CharacterName         string `json:",omitempty"`
+	RaidUserId            int32 `json:",omitempty"`
+	Created               string `json:",omitempty"`
+}
+
+type Invite struct {
+	Code                  string
+	Created               string
+}
+
+// Data sent with webhook events
+type MemberEvent struct {
+	RaidUserId            int32 `json:",omitempty"`
+	CharacterName         string `json:",omitempty"` // Bound or last reported character, if known
+	Verified              bool
+	Connected             time.Time
+}
+
+type EncounterEvent struct {
+	leaderboard.EncounterKey
+	catalog.Resolved
+	CombatStart           time.Time
+}
+
+type EncounterEndedEvent struct {
+	EncounterEvent
+	CombatEnd             time.Time
+	Results               []stats.UserStats // Final stats of everyone who finished the encounter
+}
+
+type PersonalBestEvent struct {
+	leaderboard.Result
+	catalog.Resolved
+	Metrics               []string // Metrics the result is a new best for
+}
+
+type GroupEvent struct {
+	Reason                string // admin, operator or expired
 }
 
 type RaidGroupStore struct {
@@ -59,66 +189,339 @@ type RaidGroup struct {
     id uint32
     name string
     users []*User
+    version uint64 // Incremented whenever the group's stats change
+    epoch string // Random for each time the group is loaded, since version starts over
+    changed chan struct{} // Closed and replaced whenever version changes
+    roles map[string]string // Roles assigned by the group admin, by identity.Key of the character name
+    spectators int // Connected spectators, which keep the group alive but aren't in users
+    bans []Ban
+    claimed map[string]bool // Characters claimed with a secret, by identity.Key
+    fight *groupFight // Encounter members are in, for webhooks
+
+    // Serialized responses for the current version, keyed by format and
+    // Accept-Encoding, so members polling the same group share one encode
+    cacheLock sync.Mutex
+    cacheVersion uint64
+    cache map[string]*cachedResponse
+}
+
+type cachedResponse struct {
+    contentType string
+    encoding string
+    body []byte
+}
+
+// An encounter a group is fighting. Members each report their own combat
+// start, so theirs only have to be close to the fight's.
+type groupFight struct {
+    key leaderboard.EncounterKey
+    start time.Time
+    end time.Time // Latest combat end of the results so far
+    results []stats.UserStats
 }
 
 const (
 	// Database
-	tableCreate = "CREATE TABLE IF NOT EXISTS raid_groups (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL UNIQUE, name TEXT NOT NULL UNIQUE, password TEXT, admin_password TEXT, datetime TEXT);"
-	createRaidGroup = "INSERT INTO raid_groups VALUES (NULL, ?, ?, ?, ?)"
-	deleteRaidGroup = "DELETE FROM raid_groups WHERE name=? AND admin_password=?"
-	selectRaidGroup = "SELECT id, password FROM raid_groups WHERE name=?"
+	createRaidGroup = "INSERT INTO raid_groups (name, name_key, password, admin_password, datetime, last_used, description, owner_contact, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+
+	// Groups are looked up by normalized name, or exact name for legacy groups
+	// whose normalized name collided with another's, preferring an exact match.
+	// Takes the key as ?1 and the name as ?2.
+	matchRaidGroupName = "id=(SELECT id FROM raid_groups WHERE name_key=?1 OR (name_key IS NULL AND name=?2) ORDER BY name=?2 DESC LIMIT 1)"
+	selectRaidGroupInfo = "SELECT name, description, owner_contact, COALESCE(datetime, ''), COALESCE(last_used, datetime, ''), status FROM raid_groups WHERE id=?"
+	selectRaidGroups = "SELECT id, name, description, owner_contact, COALESCE(datetime, ''), COALESCE(last_used, datetime, ''), status FROM raid_groups ORDER BY name"
+	updateRaidGroupStatus = "UPDATE raid_groups SET status=? WHERE id=?"
+	selectActiveRaidGroup = "SELECT id, password FROM raid_groups WHERE " + matchRaidGroupName + " AND status='active'"
+	updateRaidGroupAdminPassword = "UPDATE raid_groups SET admin_password=? WHERE id=?"
+	selectRaidGroupsUsed = "SELECT id, name, COALESCE(last_used, datetime) FROM raid_groups"
+	updateRaidGroupUsed = "UPDATE raid_groups SET last_used=? WHERE id=?"
+	updateRaidGroupDescription = "UPDATE raid_groups SET description=?, owner_contact=? WHERE id=?"
+	selectRaidGroup = "SELECT id, password FROM raid_groups WHERE " + matchRaidGroupName
+	selectRaidGroupAdmin = "SELECT id FROM raid_groups WHERE " + matchRaidGroupName + " AND admin_password=?3"
+	selectRoles = "SELECT character_name, role FROM raid_group_roles WHERE group_id=? ORDER BY rowid" // Latest assignment last
+	upsertRole = "INSERT OR REPLACE INTO raid_group_roles VALUES (?, ?, ?)"
+	deleteRole = "DELETE FROM raid_group_roles WHERE group_id=? AND character_name=?"
+	createInvite = "INSERT INTO raid_group_invites VALUES (?, ?, ?)"
+	deleteInvite = "DELETE FROM raid_group_invites WHERE code=? AND group_id=?"
+	selectInvites = "SELECT code, datetime FROM raid_group_invites WHERE group_id=? ORDER BY datetime"
+	createBan = "INSERT OR IGNORE INTO raid_group_bans VALUES (?, ?, ?, ?)"
+	deleteBan = "DELETE FROM raid_group_bans WHERE group_id=? AND character_name=? AND raid_user_id=?"
+	selectBans = "SELECT character_name, raid_user_id, datetime FROM raid_group_bans WHERE group_id=? ORDER BY datetime"
+	updateRaidGroupPassword = "UPDATE raid_groups SET password=? WHERE id=?"
+	updateRaidGroupName = "UPDATE raid_groups SET name=?, name_key=? WHERE id=?"
+	selectInviteGroup = "SELECT g.id, g.name FROM raid_group_invites i JOIN raid_groups g ON g.id=i.group_id WHERE i.code=? AND g.status='active'"
 
 	// GC Configs
 	gcCheckFrequency = 1*time.Minute
 	inactiveTimeoutDuration = 5*time.Minute
+	expiryCheckFrequency = 1*time.Hour
+	webhookDeliveryRetention = 7*24*time.Hour
+
+	// Long-poll Configs
+	maxStatsWait = 60*time.Second
+
+	// Request body limits, after decompression
+	maxStatsBodySize = 1 << 20
+	maxCombatLogBodySize = 16 << 20
+
+	// Furthest a combat log's UTC offset can be from UTC, in minutes
+	maxCombatLogOffset = 14 * 60
+
+	// Leaderboard Configs
+	maxLeaderboardLimit = 100
+
+	// Group statuses
+	groupActive = "active"
+	groupLocked = "locked"
+	groupPending = "pending"
+
+	// History Configs
+	historyCapacity = 1800 // 30 minutes at 1 Hz
+	maxHistoryBucket = 5*time.Minute
 )
 
 var (
 	// Database
 	createRaidGroupStmt *sql.Stmt
-	deleteRaidGroupStmt *sql.Stmt
 	selectRaidGroupStmt *sql.Stmt
+	selectRaidGroupAdminStmt *sql.Stmt
+	selectRolesStmt     *sql.Stmt
+	upsertRoleStmt      *sql.Stmt
+	deleteRoleStmt      *sql.Stmt
+	createInviteStmt    *sql.Stmt
+	deleteInviteStmt    *sql.Stmt
+	selectInvitesStmt   *sql.Stmt
+	selectInviteGroupStmt *sql.Stmt
+	createBanStmt       *sql.Stmt
+	deleteBanStmt       *sql.Stmt
+	selectBansStmt      *sql.Stmt
+	updateRaidGroupPasswordStmt *sql.Stmt
+	updateRaidGroupNameStmt *sql.Stmt
+	selectRaidGroupInfoStmt *sql.Stmt
+	selectRaidGroupsUsedStmt *sql.Stmt
+	updateRaidGroupUsedStmt *sql.Stmt
+	updateRaidGroupDescriptionStmt *sql.Stmt
+	db                  *sql.DB
 
 	// In-memory collections
 	allUsers            *UserStore
 	allRaidGroups       *RaidGroupStore
+
+	// Polling rate limits
+	pollLimiter         *polling.Limiter
+
+	// Finished encounters
+	leaderboards        *leaderboard.Store
+	encounterCatalog    *catalog.Catalog
+
+	// Characters claimed by players
+	identities          *identity.Store
+
+	// Notifications for raid events
+	webhooks            *webhook.Dispatcher
+
+	// Server operator credentials, which admin endpoints are disabled without
+	operatorKey         string
+
+	selectRaidGroupsStmt *sql.Stmt
+	updateRaidGroupStatusStmt *sql.Stmt
+	selectActiveRaidGroupStmt *sql.Stmt
+	updateRaidGroupAdminPasswordStmt *sql.Stmt
+
+	// Groups unused for this many days are deleted, or never if zero
+	groupExpiryDays     int
+
+	// New groups need the server operator's approval before they can be used
+	requireApproval     bool
 )
 
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	// Open database
-	db, err := sql.Open("sqlite3", "./raid_groups.db")
+	var err error
+	db, err = sql.Open("sqlite3", databasePath())
 	if err != nil {
 		log.Fatalf("Error opening database: %v", err)
 	}
 	defer db.Close()
 
-	// Prepare SQL queries
-	_, err = db.Exec(tableCreate)
+	// Serve unless given another command
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	// Database maintenance happens before migrating, so it can report on and
+	// back up the schema as it was
+	if command == "db" {
+		dbCommand(args)
+		return
+	} else if command == "migrate" {
+		migrateCommand(args)
+		return
+	}
+
+	// Bring the schema up to date
+	applied, err := migrations.Migrate(db)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, m := range applied {
+		log.Printf("Applied schema migration %d: %s", m.Version, m.Name)
+	}
+	reportNameCollisions(groupname.Backfill(db))
+	reportClaimCollisions(identity.Rekey(db))
+
+	// Prepare SQL queries
 	createRaidGroupStmt, err = db.Prepare(createRaidGroup)
 	if err != nil {
 		log.Fatal(err)
 	}
-	deleteRaidGroupStmt, err = db.Prepare(deleteRaidGroup)
+	selectRaidGroupStmt, err = db.Prepare(selectRaidGroup)
 	if err != nil {
 		log.Fatal(err)
 	}
-	selectRaidGroupStmt, err = db.Prepare(selectRaidGroup)
+	selectRaidGroupAdminStmt, err = db.Prepare(selectRaidGroupAdmin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	selectRolesStmt, err = db.Prepare(selectRoles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	upsertRoleStmt, err = db.Prepare(upsertRole)
+	if err != nil {
+		log.Fatal(err)
+	}
+	deleteRoleStmt, err = db.Prepare(deleteRole)
+	if err != nil {
+		log.Fatal(err)
+	}
+	createInviteStmt, err = db.Prepare(createInvite)
+	if err != nil {
+		log.Fatal(err)
+	}
+	deleteInviteStmt, err = db.Prepare(deleteInvite)
+	if err != nil {
+		log.Fatal(err)
+	}
+	selectInvitesStmt, err = db.Prepare(selectInvites)
+	if err != nil {
+		log.Fatal(err)
+	}
+	selectInviteGroupStmt, err = db.Prepare(selectInviteGroup)
+	if err != nil {
+		log.Fatal(err)
+	}
+	createBanStmt, err = db.Prepare(createBan)
+	if err != nil {
+		log.Fatal(err)
+	}
+	deleteBanStmt, err = db.Prepare(deleteBan)
+	if err != nil {
+		log.Fatal(err)
+	}
+	selectBansStmt, err = db.Prepare(selectBans)
+	if err != nil {
+		log.Fatal(err)
+	}
+	updateRaidGroupPasswordStmt, err = db.Prepare(updateRaidGroupPassword)
+	if err != nil {
+		log.Fatal(err)
+	}
+	updateRaidGroupNameStmt, err = db.Prepare(updateRaidGroupName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	selectRaidGroupInfoStmt, err = db.Prepare(selectRaidGroupInfo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	selectRaidGroupsUsedStmt, err = db.Prepare(selectRaidGroupsUsed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	updateRaidGroupUsedStmt, err = db.Prepare(updateRaidGroupUsed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	updateRaidGroupDescriptionStmt, err = db.Prepare(updateRaidGroupDescription)
+	if err != nil {
+		log.Fatal(err)
+	}
+	selectRaidGroupsStmt, err = db.Prepare(selectRaidGroups)
+	if err != nil {
+		log.Fatal(err)
+	}
+	updateRaidGroupAdminPasswordStmt, err = db.Prepare(updateRaidGroupAdminPassword)
+	if err != nil {
+		log.Fatal(err)
+	}
+	updateRaidGroupStatusStmt, err = db.Prepare(updateRaidGroupStatus)
 	if err != nil {
 		log.Fatal(err)
 	}
+	selectActiveRaidGroupStmt, err = db.Prepare(selectActiveRaidGroup)
+	if err != nil {
+		log.Fatal(err)
+	}
+	leaderboards, err = leaderboard.NewStore(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	encounterCatalog, err = catalog.Load(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	identities, err = identity.NewStore(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch command {
+	case "serve":
+		serve()
+	case "export":
+		exportCommand(args)
+	case "group":
+		groupCommand(args)
+	case "sessions":
+		sessionsCommand(args)
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: parsec2 [serve | export | group | sessions | db | migrate]")
+		os.Exit(2)
+	}
+}
+
+// Runs the API server until it's killed
+func serve() {
+	var err error
 
 	// Initialize in-memory stores
 	allUsers = &UserStore{users:map[uuid.UUID]*User{}}
 	allRaidGroups = &RaidGroupStore{raidGroups:map[uint32]*RaidGroup{}}
+	pollLimiter = polling.NewLimiter()
+	webhooks = newWebhookDispatcher()
 
 	// Start up GC for inactive users and groups
 	go garbageCollectInactive()
 
+	// Operator key for admin endpoints
+	operatorKey = os.Getenv("OPERATOR_KEY")
+
+	requireApproval = os.Getenv("GROUP_APPROVAL") == "true"
+
+	// Group expiry
+	if os.Getenv("GROUP_EXPIRY_DAYS") != "" {
+		groupExpiryDays, err = strconv.Atoi(os.Getenv("GROUP_EXPIRY_DAYS"))
+		if err != nil || groupExpiryDays < 0 {
+			log.Fatalf("Invalid GROUP_EXPIRY_DAYS: %q", os.Getenv("GROUP_EXPIRY_DAYS"))
+		}
+	}
+
 	// What port are we running on?
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -131,6 +534,25 @@ func main() {
 	http.HandleFunc("/api/v2/raid_group", raidGroupHandler)
 	http.HandleFunc("/api/v2/connect", connectHandler)
 	http.HandleFunc("/api/v2/stats", statsHandler)
+	http.HandleFunc("/api/v2/combat_log", combatLogHandler)
+	http.HandleFunc("/api/v2/abilities", abilitiesHandler)
+	http.HandleFunc("/api/v2/history", historyHandler)
+	http.HandleFunc("/api/v2/leaderboard", leaderboardHandler)
+	http.HandleFunc("/api/v2/personal_bests", personalBestsHandler)
+	http.HandleFunc("/api/v2/encounters", encountersHandler)
+	http.HandleFunc("/api/v2/export", exportHandler)
+	http.HandleFunc("/api/v2/roles", rolesHandler)
+	http.HandleFunc("/api/v2/invites", invitesHandler)
+	http.HandleFunc("/api/v2/members", membersHandler)
+	http.HandleFunc("/api/v2/bans", bansHandler)
+	http.HandleFunc("/api/v2/characters", charactersHandler)
+	http.HandleFunc("/api/v2/webhooks", webhooksHandler)
+	http.HandleFunc("/api/v2/webhook_test", webhookTestHandler)
+	http.HandleFunc("/api/v2/webhook_deliveries", webhookDeliveriesHandler)
+	http.HandleFunc("/api/v2/expired_groups", expiredGroupsHandler)
+	http.HandleFunc("/api/v2/sessions", sessionsHandler)
+	http.HandleFunc("/api/v2/groups", groupsHandler)
+	http.Handle("/", dashboard.Handler())
 	http.ListenAndServe(httpPort, nil)
 }
 
@@ -145,7 +567,18 @@ func raidGroupHandler(w http.ResponseWriter, r *http.Request) {
 		groupId := loginRaid(name, password)
 		if groupId == 0 {
 			http.Error(w, "Invalid group name or password", 401)
+			return
+		}
+
+		// Send back the group's details
+		info, err := loadRaidGroupInfo(groupId)
+		if err != nil {
+			log.Printf("Error loading raid group: %v", err)
+			http.Error(w, "Error loading raid group", 500)
+			return
 		}
+		body, _ := json.Marshal(&info)
+		compression.Write(w, r, "application/json", body)
 	} else if r.Method == "POST" {
 		// Validate params
 		if name == "" || password == "" || adminPassword == "" {
@@ -153,28 +586,117 @@ func raidGroupHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Attempt to create it
-		result, _ := createRaidGroupStmt.Exec(name, password, adminPassword, time.Now().Format(time.RFC3339))
+		displayName, nameKey, err := groupname.Validate(name)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		// Attempt to create it, waiting for the operator to approve it if
+		// they've asked to
+		status := groupActive
+		if requireApproval {
+			status = groupPending
+		}
+		now := time.Now().Format(time.RFC3339)
+		result, _ := createRaidGroupStmt.Exec(displayName, nameKey, password, adminPassword, now, now, params.Get("description"), params.Get("ownerContact"), status)
 		if result != nil {
-			log.Printf("Created raid group: '%s'", name)
-			w.Write([]byte("Raid group created successfully"))
+			log.Printf("Created raid group: '%s' (%s)", displayName, status)
+			if requireApproval {
+				w.WriteHeader(202)
+				w.Write([]byte("Raid group created, waiting for approval"))
+			} else {
+				w.Write([]byte("Raid group created successfully"))
+			}
 		} else {
 			http.Error(w, "A group with the given name already exists", 400)
 		}
 	} else if r.Method == "DELETE" {
-		qres, _ := deleteRaidGroupStmt.Exec(name, adminPassword)
-		if qres == nil {
+		groupId := loginAdmin(name, adminPassword)
+		if groupId == 0 {
+			http.Error(w, "Invalid group name or admin password", 400)
+			return
+		}
+		err := groupname.Delete(db, groupId)
+		if err != nil {
+			log.Printf("Error deleting raid group: %v", err)
 			http.Error(w, "Delete failed", 500)
 			return
 		}
+		kickUsers(groupId, func(user *User) bool { return true })
+		log.Printf("Deleted raid group: '%s'", name)
+		webhooks.Send(groupId, name, webhook.GroupDeleted, GroupEvent{Reason:"admin"})
+		w.Write([]byte("Raid group deleted successfully"))
+	} else if r.Method == "PUT" {
+		groupId := loginAdmin(name, adminPassword)
+		if groupId == 0 {
+			http.Error(w, "Invalid group name or admin password", 401)
+			return
+		}
+		newName := params.Get("newName")
+		newPassword := params.Get("newPassword")
+		_, hasDescription := params["description"]
+		_, hasOwnerContact := params["ownerContact"]
+		if newName == "" && newPassword == "" && !hasDescription && !hasOwnerContact {
+			http.Error(w, "Nothing to update", 400)
+			return
+		}
 
-		affected, _ := qres.RowsAffected()
-		if affected == 1 {
-			log.Printf("Deleted raid group: '%s'", name)
-			w.Write([]byte("Raid group deleted successfully"))
-		} else {
-			http.Error(w, "Invalid group name or admin password", 400)
+		// Update description and contact, keeping whichever wasn't given
+		if hasDescription || hasOwnerContact {
+			info, _ := loadRaidGroupInfo(groupId)
+			if hasDescription {
+				info.Description = params.Get("description")
+			}
+			if hasOwnerContact {
+				info.OwnerContact = params.Get("ownerContact")
+			}
+			_, err := updateRaidGroupDescriptionStmt.Exec(info.Description, info.OwnerContact, groupId)
+			if err != nil {
+				log.Printf("Error updating raid group: %v", err)
+				http.Error(w, "Error updating raid group", 500)
+				return
+			}
+		}
+
+		// Rename
+		if newName != "" && newName != name {
+			displayName, nameKey, err := groupname.Validate(newName)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			newName = displayName
+			result, _ := updateRaidGroupNameStmt.Exec(newName, nameKey, groupId)
+			if result == nil {
+				http.Error(w, "A group with the given name already exists", 400)
+				return
+			}
+			allRaidGroups.RLock()
+			raidGroup := allRaidGroups.raidGroups[groupId]
+			allRaidGroups.RUnlock()
+			if raidGroup != nil {
+				raidGroup.Lock()
+				raidGroup.name = newName
+				raidGroup.Unlock()
+			}
+			log.Printf("Renamed raid group: '%s' to '%s'", name, newName)
+		}
+
+		// Rotate password, disconnecting everyone unless asked not to
+		if newPassword != "" {
+			_, err := updateRaidGroupPasswordStmt.Exec(newPassword, groupId)
+			if err != nil {
+				log.Printf("Error updating password: %v", err)
+				http.Error(w, "Error updating password", 500)
+				return
+			}
+			if params.Get("keepSessions") != "true" {
+				kicked := kickUsers(groupId, func(user *User) bool { return true })
+				log.Printf("Rotated password for raid group %d, disconnected %d users", groupId, kicked)
+			}
 		}
+		w.Write([]byte("Raid group updated successfully"))
 	} else {
 		http.Error(w, "Unsupported method", 404)
 	}
@@ -187,45 +709,121 @@ func connectHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check login
+	// Check login. Invite codes connect as a spectator instead of a member,
+	// as do members who only want to watch, like the web dashboard.
 	params := r.URL.Query()
-	name := params.Get("name")
-	groupId := loginRaid(name, params.Get("password"))
-	if groupId == 0 {
-		http.Error(w, "Invalid group name or password", 401)
+	var name string
+	var groupId uint32
+	spectator := params.Get("invite") != "" || params.Get("spectator") == "true"
+	if params.Get("invite") != "" {
+		selectInviteGroupStmt.QueryRow(params.Get("invite")).Scan(&groupId, &name)
+		if groupId == 0 {
+			http.Error(w, "Invalid invite code", 401)
+			return
+		}
+	} else {
+		groupId = loginRaid(params.Get("name"), params.Get("password"))
+		if groupId == 0 {
+			http.Error(w, "Invalid group name or password", 401)
+			return
+		}
+
+		// Use the name as it was registered, not however it was typed
+		info, _ := loadRaidGroupInfo(groupId)
+		name = info.Name
+	}
+
+	// Members can bind their connection to a character. Claimed characters
+	// need their secret, and a secret for an unclaimed one claims it.
+	character := strings.TrimSpace(params.Get("character"))
+	secret := params.Get("secret")
+	verified := false
+	if character != "" && !spectator && isBanned(loadBans(groupId), stats.UserStats{CharacterName:character}) {
+		http.Error(w, "Banned from raid group", 403)
 		return
 	}
+	if character != "" && !spectator {
+		claimed, err := identities.Verify(groupId, character, secret)
+		if err == identity.ErrWrongSecret {
+			http.Error(w, "Invalid character secret", 401)
+			return
+		} else if err != nil {
+			log.Printf("Error verifying character: %v", err)
+			http.Error(w, "Error verifying character", 500)
+			return
+		}
+		if !claimed && secret != "" {
+			err = identities.Claim(groupId, character, secret)
+			if err == identity.ErrSecretLength {
+				http.Error(w, err.Error(), 400)
+				return
+			} else if err == identity.ErrAlreadyClaimed {
+				http.Error(w, "Invalid character secret", 401)
+				return
+			} else if err != nil {
+				log.Printf("Error claiming character: %v", err)
+				http.Error(w, "Error claiming character", 500)
+				return
+			}
+			log.Printf("Character claimed: %s in %s", character, name)
+			claimed = true
+		}
+		verified = claimed
+	}
 
 	// Create user
 	token := uuid.NewV4()
 	tokenStr := token.String()
-	user := &User{token:token, lastActivity:time.Now()}
-	log.Printf("User connected: %s", tokenStr)
+	now := time.Now()
+	user := &User{token:token, connected:now, lastActivity:now, spectator:spectator, character:character, verified:verified}
+	if spectator {
+		log.Printf("Spectator connected: %s", tokenStr)
+	} else {
+		log.Printf("User connected: %s", tokenStr)
+	}
 
 	// Add user to user store
 	allUsers.Lock()
 	allUsers.users[token] = user
 	allUsers.Unlock()
 
+	// Remember when the group was last used, so it doesn't expire
+	updateRaidGroupUsedStmt.Exec(time.Now().Format(time.RFC3339), groupId)
+
+	// Load admin-assigned roles, bans and claims in case the group isn't in
+	// memory yet
+	groupRoles := loadRoles(groupId)
+	groupBans := loadBans(groupId)
+	groupClaims := loadClaims(groupId)
+
 	// Add them to their raid group
 	allRaidGroups.Lock()
 	raidGroup := allRaidGroups.raidGroups[groupId]
-	if raidGroup != nil {
-		// Add the user to the existing raid group
-		raidGroup.Lock()
-		raidGroup.users = append(raidGroup.users, user)
-		raidGroup.Unlock()
-	} else {
-		// Create a new raid group that contains the user
+	if raidGroup == nil {
+		// Create a new raid group
 		users := make([]*User, 0, 16)
-		users = append(users, user)
-		raidGroup = &RaidGroup{id:groupId, name:name, users:users}
+		raidGroup = &RaidGroup{id:groupId, name:name, users:users, version:1, epoch:randomPassword(), changed:make(chan struct{}), roles:keyRoles(groupRoles), bans:groupBans, claimed:groupClaims}
 		allRaidGroups.raidGroups[groupId] = raidGroup
 	}
+	raidGroup.Lock()
+	if verified {
+		raidGroup.claimed[identity.Key(character)] = true
+	}
+	if spectator {
+		// Spectators don't show up in the group's stats, so nothing changes
+		raidGroup.spectators++
+	} else {
+		raidGroup.users = append(raidGroup.users, user)
+		raidGroupChanged(raidGroup)
+	}
+	raidGroup.Unlock()
 	allRaidGroups.Unlock()
 
 	// Set user's raidGroup property so it knows what group it belongs to
 	user.raidGroup = raidGroup
+	if !spectator {
+		notify(raidGroup, webhook.MemberConnected, MemberEvent{CharacterName:character, Verified:verified, Connected:now})
+	}
 
 	// Write out token
 	w.Write([]byte(tokenStr))
@@ -233,11 +831,9 @@ func connectHandler(w http.ResponseWriter, r *http.Request) {
 
 func statsHandler(w http.ResponseWriter, r *http.Request) {
 	// Look up user by token
-	tokenStr := r.URL.Query().Get("t")
-	token, _ := uuid.FromString(tokenStr)
-	allUsers.RLock()
-	user := allUsers.users[token]
-	allUsers.RUnlock()
+	params := r.URL.Query()
+	tokenStr := params.Get("t")
+	user := findUser(tokenStr)
 	if user == nil {
 		http.Error(w, "Invalid connection token", 400)
 		return
@@ -246,64 +842,2359 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 	// Update activity timestamp
 	user.lastActivity = time.Now()
 
+	// Spectators are read-only
+	if r.Method == "POST" && user.spectator {
+		http.Error(w, "Spectators cannot send stats", 403)
+		return
+	}
+
 	// Update user stats if POST
 	if r.Method == "POST" {
-		// Parse JSON
-		var userStats UserStats
-		err := json.NewDecoder(r.Body).Decode(&userStats)
+		// Decompress body if needed
+		err := compression.DecodeRequestBody(r)
 		if err != nil {
-			http.Error(w, "Invalid JSON", 400)
+			http.Error(w, "Unsupported Content-Encoding", 415)
 			return
 		}
 
-		// Update user
-		user.stats = userStats
-	}
+		// Parse stats in whatever format the client sent
+		format := stats.RequestFormat(r.Header.Get("Content-Type"))
+		body, ok := readRequestBody(w, r, maxStatsBodySize)
+		if !ok {
+			return
+		}
+		var update stats.StatsUpdate
+		err = stats.UnmarshalUpdate(format, body, &update)
+		if err != nil {
+			http.Error(w, "Invalid stats: " + err.Error(), 400)
+			return
+		}
+		err = update.Validate(time.Now())
+		if err != nil {
+			http.Error(w, "Invalid stats: " + err.Error(), 400)
+			return
+		}
+		userStats := update.UserStats
+		userStats.Role = roles.Normalize(userStats.Role)
 
-	// Build response
-	raidGroupStats := calculateRaidStats(user.raidGroup)
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Content-Encoding", "gzip")
-	gz, _ := cgzip.NewWriterLevel(w, 1)
-	json.NewEncoder(gz).Encode(&raidGroupStats)
-	gz.Close()
-}
+		// Connections bound to a character can only report as it, and claimed
+		// characters can only be reported by connections bound to them
+		if code, message := authorizeCharacter(user, userStats.CharacterName, params.Get("secret")); code != 0 {
+			http.Error(w, message, code)
+			return
+		}
 
-func loginRaid(group string, password string) uint32 {
-	var id uint32
-	var groupPassword string
-	selectRaidGroupStmt.QueryRow(group).Scan(&id, &groupPassword)
-	if password == groupPassword {
-		return id
-	} else {
-		return 0
-	}
-}
+		// Banned characters are disconnected as soon as they identify themselves
+		if disconnectIfBanned(user, userStats) {
+			http.Error(w, "Banned from raid group", 403)
+			return
+		}
 
-func calculateRaidStats(raidGroup *RaidGroup) []UserStats {
-	// Pull out all active user stats
+		// Totals computed from the user's combat log take precedence
+		if user.combatLog != nil {
+			applyCombatLogTotals(&userStats, user.combatLog.Totals())
+			update.Abilities = nil
+		}
+
+		// Update user
+		raidGroup := user.raidGroup
+		raidGroup.Lock()
+		if update.Abilities != nil {
+			user.abilities.Update(userStats.CombatStart.Time, update.Abilities)
+		}
+		var finished *stats.UserStats
+		if user.stats != userStats {
+			// Totals only go down mid-encounter if the client reset its meters
+			if decreased := stats.Decreased(&user.stats, &userStats); len(decreased) > 0 {
+				log.Printf("Stats reset for %s in %s: %s decreased", userStats.CharacterName, raidGroup.name, strings.Join(decreased, ", "))
+				w.Header().Set("X-Stats-Reset", strings.Join(decreased, ", "))
+				user.resetStart = userStats.CombatStart.Time
+			}
+			user.stats = userStats
+			recordHistory(user)
+			finished = trackEncounter(user, time.Now())
+			trackFight(raidGroup, finished)
+			raidGroupChanged(raidGroup)
+		}
+		raidGroup.Unlock()
+		if finished != nil {
+			recordEncounter(raidGroup, user, *finished)
+		}
+	}
+
+	// Parse the long-poll parameters up front, since only requests that will
+	// actually wait on the server are exempt from throttling
+	var wait time.Duration
+	var since uint64
+	longPoll := r.Method == "GET" && params.Get("wait") != "" && params.Get("since") != ""
+	if longPoll {
+		var err error
+		wait, err = parseStatsWait(params.Get("wait"))
+		if err != nil {
+			http.Error(w, "Invalid wait duration", 400)
+			return
+		}
+		since, err = strconv.ParseUint(params.Get("since"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since version", 400)
+			return
+		}
+		user.raidGroup.RLock()
+		longPoll = wait > 0 && user.raidGroup.version <= since
+		user.raidGroup.RUnlock()
+	}
+
+	// Throttle clients polling faster than their group's advertised rate.
+	// Posted stats have already been saved, so only the group's stats are
+	// withheld. Long-polls that block wait on the server instead, so they're
+	// exempt.
+	rate := raidGroupPollingRate(user.raidGroup)
+	w.Header().Set("X-Minimum-Polling-Rate", strconv.FormatUint(uint64(rate), 10))
+	if longPoll {
+		pollLimiter.Record()
+	} else if allowed, retry := pollLimiter.Allow(tokenStr, rate); !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(polling.RetryAfter(retry)))
+		http.Error(w, "Polling too frequently", 429)
+		return
+	}
+
+	// Long-poll until the group changes if requested
+	if longPoll {
+		waitForRaidStats(user.raidGroup, since, wait, r.Context().Done())
+		user.lastActivity = time.Now()
+	}
+
+	// Members can be filtered and sorted by role
+	view, err := parseRaidStatsView(params)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Skip sending anything if the client already has the latest stats
+	format := stats.NegotiateFormat(r.Header.Get("Accept"))
+	if r.Method == "GET" {
+		user.raidGroup.RLock()
+		version := user.raidGroup.version
+		user.raidGroup.RUnlock()
+		etag := raidStatsETag(user.raidGroup, version, format, view)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("X-Stats-Version", strconv.FormatUint(version, 10))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	// Build response
+	res, version := cachedRaidStats(user.raidGroup, format, r.Header.Get("Accept-Encoding"), view)
+	w.Header().Set("ETag", raidStatsETag(user.raidGroup, version, format, view))
+	w.Header().Set("X-Stats-Version", strconv.FormatUint(version, 10))
+	compression.WriteEncoded(w, res.contentType, res.encoding, res.body)
+}
+
+func combatLogHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept posts
+	if r.Method != "POST" {
+		http.Error(w, "Unsupported method", 404)
+		return
+	}
+
+	// Look up user by token
+	params := r.URL.Query()
+	user := findUser(params.Get("t"))
+	if user == nil {
+		http.Error(w, "Invalid connection token", 400)
+		return
+	}
+	user.lastActivity = time.Now()
+	if user.spectator {
+		http.Error(w, "Spectators cannot send stats", 403)
+		return
+	}
+
+	// Read log lines
+	err := compression.DecodeRequestBody(r)
+	if err != nil {
+		http.Error(w, "Unsupported Content-Encoding", 415)
+		return
+	}
+	body, ok := readRequestBody(w, r, maxCombatLogBodySize)
+	if !ok {
+		return
+	}
+
+	// Start tracking the user's log on their first batch. Log timestamps are
+	// the player's local time of day without a date, so clients can say which
+	// day the log started and their UTC offset in minutes.
+	raidGroup := user.raidGroup
+	raidGroup.Lock()
+	if user.combatLog == nil {
+		zone := time.UTC
+		if params.Get("offset") != "" {
+			offset, err := strconv.Atoi(params.Get("offset"))
+			if err != nil || offset < -maxCombatLogOffset || offset > maxCombatLogOffset {
+				raidGroup.Unlock()
+				http.Error(w, "Invalid offset", 400)
+				return
+			}
+			zone = time.FixedZone("", offset*60)
+		}
+		date := time.Now().In(zone)
+		if params.Get("date") != "" {
+			date, err = time.ParseInLocation("2006-01-02", params.Get("date"), zone)
+			if err != nil {
+				raidGroup.Unlock()
+				http.Error(w, "Invalid date", 400)
+				return
+			}
+		}
+		owner := user.stats.CharacterName
+		if owner == "" {
+			owner = user.character
+		}
+		user.combatLog = combatlog.NewAggregator(owner, date)
+	}
+	combatLog := user.combatLog
+	raidGroup.Unlock()
+
+	// Parse lines, then check the log's owner can be reported as like any
+	// other stats. The owner is only known once a line has named them, so a
+	// rejected log is thrown away.
+	res := CombatLogResponse{}
+	res.Parsed, res.Skipped = combatLog.Write(body)
+	if owner := combatLog.Owner(); owner != "" {
+		code, message := authorizeCharacter(user, owner, params.Get("secret"))
+		raidGroup.RLock()
+		identified := stats.UserStats{RaidUserId:user.stats.RaidUserId, CharacterName:owner}
+		raidGroup.RUnlock()
+		if code == 0 && disconnectIfBanned(user, identified) {
+			code, message = 403, "Banned from raid group"
+		}
+		if code != 0 {
+			raidGroup.Lock()
+			if user.combatLog == combatLog {
+				user.combatLog = nil
+			}
+			raidGroup.Unlock()
+			http.Error(w, message, code)
+			return
+		}
+	}
+
+	// Update the user's stats with the new totals
+	raidGroup.Lock()
+	userStats := user.stats
+	applyCombatLogTotals(&userStats, combatLog.Totals())
+	user.abilities = stats.EncounterAbilities{CombatStart:userStats.CombatStart.Time, Breakdown:combatLog.Abilities()}
+	if userStats.CharacterName == "" {
+		userStats.CharacterName = combatLog.Owner()
+	}
+	var finished *stats.UserStats
+	if user.stats != userStats {
+		user.stats = userStats
+		recordHistory(user)
+		finished = trackEncounter(user, time.Now())
+		trackFight(raidGroup, finished)
+		raidGroupChanged(raidGroup)
+	}
+	res.Stats = userStats
+	raidGroup.Unlock()
+	if finished != nil {
+		recordEncounter(raidGroup, user, *finished)
+	}
+
+	body, _ = json.Marshal(&res)
+	compression.Write(w, r, "application/json", body)
+}
+
+func abilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	// Look up user by token
+	params := r.URL.Query()
+	user := findUser(params.Get("t"))
+	if user == nil {
+		http.Error(w, "Invalid connection token", 400)
+		return
+	}
+	user.lastActivity = time.Now()
+
+	// Optionally only return a single member
+	filterUser := params.Get("user") != ""
+	var raidUserId int64
+	if filterUser {
+		var err error
+		raidUserId, err = strconv.ParseInt(params.Get("user"), 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid user", 400)
+			return
+		}
+	}
+
+	// Gather breakdowns for everyone in the group
+	raidGroup := user.raidGroup
+	raidGroup.RLock()
+	res := make([]stats.UserAbilities, 0, len(raidGroup.users))
+	for i := range raidGroup.users {
+		member := raidGroup.users[i]
+		if member == nil || (filterUser && member.stats.RaidUserId != int32(raidUserId)) {
+			continue
+		}
+		res = append(res, stats.UserAbilities{
+			RaidUserId:member.stats.RaidUserId,
+			CharacterName:member.stats.CharacterName,
+			CombatStart:stats.RFC3339NanoTime{Time:member.abilities.CombatStart},
+			AbilityBreakdown:member.abilities.Breakdown.Copy(),
+		})
+	}
+	raidGroup.RUnlock()
+
+	body, _ := json.Marshal(&res)
+	compression.Write(w, r, "application/json", body)
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	// Look up user by token
+	params := r.URL.Query()
+	user := findUser(params.Get("t"))
+	if user == nil {
+		http.Error(w, "Invalid connection token", 400)
+		return
+	}
+	user.lastActivity = time.Now()
+
+	// Parse options
+	filterUser := params.Get("user") != ""
+	var raidUserId int64
+	if filterUser {
+		var err error
+		raidUserId, err = strconv.ParseInt(params.Get("user"), 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid user", 400)
+			return
+		}
+	}
+	bucket := time.Second
+	if params.Get("bucket") != "" {
+		var err error
+		bucket, err = time.ParseDuration(params.Get("bucket"))
+		if err != nil || bucket < time.Second || bucket > maxHistoryBucket {
+			http.Error(w, "Invalid bucket", 400)
+			return
+		}
+	}
+
+	// Bucket up everyone's history for their current encounter
+	raidGroup := user.raidGroup
+	raidGroup.RLock()
+	res := make([]UserHistory, 0, len(raidGroup.users))
+	for i := range raidGroup.users {
+		member := raidGroup.users[i]
+		if member == nil || (filterUser && member.stats.RaidUserId != int32(raidUserId)) {
+			continue
+		}
+		memberHistory := UserHistory{
+			RaidUserId:member.stats.RaidUserId,
+			CharacterName:member.stats.CharacterName,
+			Buckets:[]history.Bucket{},
+		}
+		if member.history != nil {
+			combatStart := member.history.CombatStart()
+			memberHistory.CombatStart = stats.RFC3339NanoTime{Time:combatStart}
+			memberHistory.Buckets = history.Buckets(member.history.Snapshots(), combatStart, bucket)
+		}
+		res = append(res, memberHistory)
+	}
+	raidGroup.RUnlock()
+
+	body, _ := json.Marshal(&res)
+	compression.Write(w, r, "application/json", body)
+}
+
+func leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	// Parse encounter
+	var key leaderboard.EncounterKey
+	var ids [3]int64
+	for i, name := range []string{"encounter", "mode", "players"} {
+		var err error
+		ids[i], err = strconv.ParseInt(params.Get(name), 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid " + name, 400)
+			return
+		}
+	}
+	key.RaidEncounterId, key.RaidEncounterMode, key.RaidEncounterPlayers = int32(ids[0]), int32(ids[1]), int32(ids[2])
+
+	// Parse options
+	metric := params.Get("metric")
+	if metric == "" {
+		metric = leaderboard.DPS
+	}
+	limit := 10
+	if params.Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(params.Get("limit"))
+		if err != nil || limit < 1 || limit > maxLeaderboardLimit {
+			http.Error(w, "Invalid limit", 400)
+			return
+		}
+	}
+
+	// Server-wide boards are public, group boards need a connection token
+	var groupId uint32
+	if params.Get("scope") == "group" {
+		user := findUser(params.Get("t"))
+		if user == nil {
+			http.Error(w, "Invalid connection token", 400)
+			return
+		}
+		user.lastActivity = time.Now()
+		groupId = user.raidGroup.id
+	}
+
+	entries, err := leaderboards.Top(key, metric, groupId, limit)
+	if err == leaderboard.ErrUnknownMetric {
+		http.Error(w, "Invalid metric", 400)
+		return
+	} else if err != nil {
+		log.Printf("Error loading leaderboard: %v", err)
+		http.Error(w, "Error loading leaderboard", 500)
+		return
+	}
+
+	res := LeaderboardResponse{
+		EncounterKey:key,
+		Resolved:encounterCatalog.Resolve(key.RaidEncounterId, key.RaidEncounterMode, key.RaidEncounterPlayers),
+		Metric:metric,
+		Entries:entries,
+	}
+	body, _ := json.Marshal(&res)
+	compression.Write(w, r, "application/json", body)
+}
+
+func personalBestsHandler(w http.ResponseWriter, r *http.Request) {
+	// Look up user by token
+	params := r.URL.Query()
+	user := findUser(params.Get("t"))
+	if user == nil {
+		http.Error(w, "Invalid connection token", 400)
+		return
+	}
+	user.lastActivity = time.Now()
+
+	// Default to the user's own character
+	character := params.Get("character")
+	if character == "" {
+		character = user.stats.CharacterName
+	}
+
+	bests, err := leaderboards.PersonalBests(user.raidGroup.id, character)
+	if err != nil {
+		log.Printf("Error loading personal bests: %v", err)
+		http.Error(w, "Error loading personal bests", 500)
+		return
+	}
+
+	res := make([]PersonalBestResponse, len(bests))
+	for i := range bests {
+		res[i].PersonalBest = bests[i]
+		res[i].Resolved = encounterCatalog.Resolve(bests[i].RaidEncounterId, bests[i].RaidEncounterMode, bests[i].RaidEncounterPlayers)
+	}
+	body, _ := json.Marshal(&res)
+	compression.Write(w, r, "application/json", body)
+}
+
+func encountersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		data := encounterCatalog.All()
+		body, _ := json.Marshal(&data)
+		compression.Write(w, r, "application/json", body)
+		return
+	}
+
+	// Changes are limited to the server operator
+	if !isOperator(r) {
+		http.Error(w, "Invalid operator key", 401)
+		return
+	}
+
+	if r.Method == "POST" {
+		body, ok := readRequestBody(w, r, maxStatsBodySize)
+		if !ok {
+			return
+		}
+		var data catalog.Data
+		err := json.Unmarshal(body, &data)
+		if err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		err = encounterCatalog.Save(data)
+		if err != nil {
+			log.Printf("Error saving encounter catalog: %v", err)
+			http.Error(w, "Error saving encounter catalog", 500)
+			return
+		}
+		log.Printf("Saved %d encounters, %d modes and %d boss health values to catalog", len(data.Encounters), len(data.Modes), len(data.Health))
+		w.Write([]byte("Encounter catalog updated successfully"))
+	} else if r.Method == "DELETE" {
+		params := r.URL.Query()
+		encounterIds, err := parseIds(params["id"])
+		if err != nil {
+			http.Error(w, "Invalid id", 400)
+			return
+		}
+		modeIds, err := parseIds(params["mode"])
+		if err != nil {
+			http.Error(w, "Invalid mode", 400)
+			return
+		}
+		err = encounterCatalog.Delete(encounterIds, modeIds)
+		if err != nil {
+			log.Printf("Error deleting from encounter catalog: %v", err)
+			http.Error(w, "Error deleting from encounter catalog", 500)
+			return
+		}
+		w.Write([]byte("Encounter catalog updated successfully"))
+	} else {
+		http.Error(w, "Unsupported method", 404)
+	}
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	// Look up user by token
+	params := r.URL.Query()
+	user := findUser(params.Get("t"))
+	if user == nil {
+		http.Error(w, "Invalid connection token", 400)
+		return
+	}
+	user.lastActivity = time.Now()
+
+	format := params.Get("format")
+	if format == "" {
+		format = export.CSV
+	}
+	filter, err := parseExportFilter(params.Get("from"), params.Get("to"), params.Get("encounter"), params.Get("mode"), params.Get("players"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	filter.GroupId = user.raidGroup.id
+
+	// Export is streamed, so it's sent uncompressed with no Content-Length
+	exporter, err := export.NewWriter(format, w)
+	if err != nil {
+		http.Error(w, "Invalid format", 400)
+		return
+	}
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="parsec-%d.%s"`, user.raidGroup.id, format))
+	err = writeExport(exporter, user.raidGroup.name, filter)
+	if err != nil {
+		// Headers are already sent, so all we can do is cut the response short
+		log.Printf("Error exporting encounters: %v", err)
+	}
+}
+
+// Runs "parsec2 db migrate", which applies pending migrations, or "parsec2 db
+// migrate status", which lists them all without applying any
+func migrateCommand(args []string) {
+	if len(args) > 0 && args[0] == "status" {
+		flags := flag.NewFlagSet("migrate status", flag.ExitOnError)
+		asJSON := flags.Bool("json", false, "output JSON")
+		flags.Parse(args[1:])
+
+		statuses, err := migrations.Statuses(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rows := make([][]string, len(statuses))
+		for i, status := range statuses {
+			appliedAt := status.AppliedAt
+			if appliedAt == "" {
+				appliedAt = "pending"
+			}
+			rows[i] = []string{strconv.Itoa(status.Version), status.Name, appliedAt}
+		}
+		printOutput(*asJSON, statuses, []string{"VERSION", "NAME", "APPLIED"}, rows)
+		return
+	} else if len(args) > 0 {
+		log.Fatalf("Unknown migrate command: %q", args[0])
+	}
+
+	applied, err := migrations.Migrate(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, m := range applied {
+		fmt.Printf("Applied %d: %s\n", m.Version, m.Name)
+	}
+	if len(applied) == 0 {
+		fmt.Println("Schema is up to date")
+	}
+	reportNameCollisions(groupname.Backfill(db))
+	reportClaimCollisions(identity.Rekey(db))
+}
+
+// Logs claims dropped because another claim on the same character was made
+// under an older form of its name
+func reportClaimCollisions(collisions []identity.Collision, err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range collisions {
+		log.Printf("Character claim collision: '%s' in raid group %d normalizes to the same name as '%s', so its claim was dropped", c.CharacterName, c.GroupId, c.ConflictName)
+	}
+}
+
+// Logs legacy groups that couldn't be given a normalized name because another
+// group already has it. They can still log in by their exact name, but should
+// be renamed or deleted.
+func reportNameCollisions(collisions []groupname.Collision, err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range collisions {
+		log.Printf("Raid group name collision: '%s' (%d) normalizes to the same name as '%s' (%d)", c.Name, c.Id, c.ConflictName, c.ConflictId)
+	}
+}
+
+// Runs "parsec2 db migrate|backup"
+func dbCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: parsec2 db [migrate [status] | backup FILE]")
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "migrate":
+		migrateCommand(args[1:])
+	case "backup":
+		// Writes a consistent copy even while the server is running
+		if len(args) != 2 {
+			log.Fatal("Usage: parsec2 db backup FILE")
+		}
+		_, err := db.Exec("VACUUM INTO ?", args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Backed up to %s\n", args[1])
+	default:
+		log.Fatalf("Unknown db command: %q", args[0])
+	}
+}
+
+// Runs "parsec2 group create|delete|list|show|reset-password", which manage
+// groups directly in the database. Changes to groups with members connected
+// take effect once they reconnect.
+func groupCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: parsec2 group [create | delete | list | show | reset-password] [NAME] [flags]")
+		os.Exit(2)
+	}
+	command := args[0]
+	args = args[1:]
+
+	// The group name comes first, with flags after it
+	name := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("group " + command, flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "output JSON")
+	password := flags.String("password", "", "group password (generated if empty)")
+	adminPassword := flags.String("admin-password", "", "admin password (generated if empty)")
+	description := flags.String("description", "", "group description")
+	ownerContact := flags.String("owner-contact", "", "how to reach the group owner")
+	flags.Parse(args)
+
+	if command == "list" {
+		groups, err := loadRaidGroups()
+		if err != nil {
+			log.Fatal(err)
+		}
+		rows := make([][]string, len(groups))
+		for i, group := range groups {
+			rows[i] = []string{strconv.FormatUint(uint64(group.Id), 10), group.Name, group.Status, group.Created, group.LastUsed, group.Description}
+		}
+		printOutput(*asJSON, groups, []string{"ID", "NAME", "STATUS", "CREATED", "LAST USED", "DESCRIPTION"}, rows)
+		return
+	}
+
+	if name == "" {
+		log.Fatalf("Usage: parsec2 group %s NAME", command)
+	}
+	if command == "create" {
+		if *password == "" {
+			*password = randomPassword()
+		}
+		if *adminPassword == "" {
+			*adminPassword = randomPassword()
+		}
+		now := time.Now().Format(time.RFC3339)
+		displayName, nameKey, err := groupname.Validate(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		name = displayName
+		_, err = createRaidGroupStmt.Exec(name, nameKey, *password, *adminPassword, now, now, *description, *ownerContact, groupActive)
+		if err != nil {
+			log.Fatalf("Error creating group: %v", err)
+		}
+		credentials := map[string]string{"Name":name, "Password":*password, "AdminPassword":*adminPassword}
+		printOutput(*asJSON, credentials, []string{"NAME", "PASSWORD", "ADMIN PASSWORD"}, [][]string{{name, *password, *adminPassword}})
+		return
+	}
+
+	var groupId uint32
+	var groupPassword string
+	selectRaidGroupStmt.QueryRow(groupname.Key(name), name).Scan(&groupId, &groupPassword)
+	if groupId == 0 {
+		log.Fatalf("Raid group not found: %q", name)
+	}
+
+	switch command {
+	case "delete":
+		err := groupname.Delete(db, groupId)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Deleted raid group %s\n", name)
+
+		// Tell the group's webhooks, which also deletes them. Failed
+		// deliveries can't be retried once this exits.
+		webhooks = newWebhookDispatcher()
+		webhooks.Send(groupId, name, webhook.GroupDeleted, GroupEvent{Reason:"operator"})
+		webhooks.Flush()
+	case "show":
+		info, err := loadRaidGroupInfo(groupId)
+		if err != nil {
+			log.Fatal(err)
+		}
+		details := RaidGroupDetails{RaidGroupInfo:info, Roles:loadRoles(groupId), Invites:loadInvites(groupId), Bans:loadBans(groupId)}
+		if *asJSON {
+			printOutput(true, details, nil, nil)
+			return
+		}
+		rows := [][]string{
+			{"Id", strconv.FormatUint(uint64(info.Id), 10)},
+			{"Name", info.Name},
+			{"Status", info.Status},
+			{"Description", info.Description},
+			{"Owner contact", info.OwnerContact},
+			{"Created", info.Created},
+			{"Last used", info.LastUsed},
+			{"Roles", strconv.Itoa(len(details.Roles))},
+			{"Invites", strconv.Itoa(len(details.Invites))},
+			{"Bans", strconv.Itoa(len(details.Bans))},
+		}
+		printOutput(false, nil, []string{"FIELD", "VALUE"}, rows)
+	case "reset-password":
+		// Resets the group password, and the admin password too if given
+		if *password == "" {
+			*password = randomPassword()
+		}
+		_, err := updateRaidGroupPasswordStmt.Exec(*password, groupId)
+		if err != nil {
+			log.Fatal(err)
+		}
+		credentials := map[string]string{"Name":name, "Password":*password}
+		if *adminPassword != "" {
+			_, err = updateRaidGroupAdminPasswordStmt.Exec(*adminPassword, groupId)
+			if err != nil {
+				log.Fatal(err)
+			}
+			credentials["AdminPassword"] = *adminPassword
+		}
+		printOutput(*asJSON, credentials, []string{"NAME", "PASSWORD", "ADMIN PASSWORD"}, [][]string{{name, *password, *adminPassword}})
+	default:
+		log.Fatalf("Unknown group command: %q", command)
+	}
+}
+
+// Runs "parsec2 sessions list". Sessions only exist in the running server, so
+// this asks it for them using the operator key.
+func sessionsCommand(args []string) {
+	if len(args) == 0 || args[0] != "list" {
+		fmt.Fprintln(os.Stderr, "Usage: parsec2 sessions list [-server URL] [-json]")
+		os.Exit(2)
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	flags := flag.NewFlagSet("sessions list", flag.ExitOnError)
+	server := flags.String("server", "http://localhost:" + port, "server URL")
+	asJSON := flags.Bool("json", false, "output JSON")
+	flags.Parse(args[1:])
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(*server, "/") + "/api/v2/sessions", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("X-Operator-Key", os.Getenv("OPERATOR_KEY"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		log.Fatalf("Error listing sessions: %s", strings.TrimSpace(string(body)))
+	}
+	var sessions []Session
+	err = json.NewDecoder(resp.Body).Decode(&sessions)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	now := time.Now()
+	rows := make([][]string, len(sessions))
+	for i, session := range sessions {
+		kind := "member"
+		if session.Spectator {
+			kind = "spectator"
+		}
+		rows[i] = []string{
+			session.Group, session.CharacterName, kind,
+			now.Sub(session.Connected).Round(time.Second).String(),
+			now.Sub(session.LastActivity).Round(time.Second).String(),
+		}
+	}
+	printOutput(*asJSON, sessions, []string{"GROUP", "CHARACTER", "TYPE", "CONNECTED", "IDLE"}, rows)
+}
+
+// Prints v as indented JSON, or the rows as an aligned table
+func printOutput(asJSON bool, v interface{}, header []string, rows [][]string) {
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(v)
+		return
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(table, strings.Join(row, "\t"))
+	}
+	table.Flush()
+}
+
+func randomPassword() string {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Where the database lives, shared by the server and the admin commands
+func databasePath() string {
+	path := os.Getenv("DATABASE_PATH")
+	if path == "" {
+		path = "./raid_groups.db"
+	}
+	return path
+}
+
+func loadRaidGroupInfo(groupId uint32) (RaidGroupInfo, error) {
+	info := RaidGroupInfo{Id:groupId}
+	err := selectRaidGroupInfoStmt.QueryRow(groupId).Scan(&info.Name, &info.Description, &info.OwnerContact, &info.Created, &info.LastUsed, &info.Status)
+	return info, err
+}
+
+func loadRaidGroups() ([]RaidGroupInfo, error) {
+	rows, err := selectRaidGroupsStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := make([]RaidGroupInfo, 0, 32)
+	for rows.Next() {
+		var info RaidGroupInfo
+		err = rows.Scan(&info.Id, &info.Name, &info.Description, &info.OwnerContact, &info.Created, &info.LastUsed, &info.Status)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, info)
+	}
+	return groups, rows.Err()
+}
+
+// Runs "parsec2 export", which writes a group's encounters to a file or stdout
+func exportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	group := flags.String("group", "", "raid group name")
+	format := flags.String("format", export.CSV, "csv, ndjson or parquet")
+	from := flags.String("from", "", "earliest combat start (date or RFC3339)")
+	to := flags.String("to", "", "latest combat start (date or RFC3339)")
+	encounter := flags.String("encounter", "", "RaidEncounterId to limit to")
+	mode := flags.String("mode", "", "RaidEncounterMode to limit to")
+	players := flags.String("players", "", "RaidEncounterPlayers to limit to")
+	output := flags.String("o", "", "output file (default stdout)")
+	flags.Parse(args)
+
+	filter, err := parseExportFilter(*from, *to, *encounter, *mode, *players)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var password string
+	selectRaidGroupStmt.QueryRow(groupname.Key(*group), *group).Scan(&filter.GroupId, &password)
+	if filter.GroupId == 0 {
+		log.Fatalf("Raid group not found: %q", *group)
+	}
+	info, err := loadRaidGroupInfo(filter.GroupId)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	exporter, err := export.NewWriter(*format, out)
+	if err != nil {
+		log.Fatalf("Invalid format: %q", *format)
+	}
+	err = writeExport(exporter, info.Name, filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func writeExport(exporter export.Writer, groupName string, filter leaderboard.Filter) error {
+	err := leaderboards.Each(filter, func(result leaderboard.Result) error {
+		return exporter.Write(export.NewRow(groupName, result, encounterCatalog))
+	})
+	if err != nil {
+		return err
+	}
+	return exporter.Close()
+}
+
+// Parses export options. Times may be dates or RFC3339 timestamps, and a date
+// for the end of the range includes that whole day. The encounter is optional,
+// but needs all three ids if given.
+func parseExportFilter(from string, to string, encounter string, mode string, players string) (leaderboard.Filter, error) {
+	var filter leaderboard.Filter
+	var err error
+	if from != "" {
+		filter.From, err = parseExportTime(from, false)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid from")
+		}
+	}
+	if to != "" {
+		filter.To, err = parseExportTime(to, true)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid to")
+		}
+	}
+	if encounter == "" && mode == "" && players == "" {
+		return filter, nil
+	}
+
+	var ids [3]int64
+	for i, value := range []string{encounter, mode, players} {
+		ids[i], err = strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid %s", []string{"encounter", "mode", "players"}[i])
+		}
+	}
+	filter.Encounter = leaderboard.EncounterKey{
+		RaidEncounterId:int32(ids[0]),
+		RaidEncounterMode:int32(ids[1]),
+		RaidEncounterPlayers:int32(ids[2]),
+	}
+	return filter, nil
+}
+
+func parseExportTime(value string, end bool) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func rolesHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	if r.Method == "GET" {
+		// Look up user by token
+		user := findUser(params.Get("t"))
+		if user == nil {
+			http.Error(w, "Invalid connection token", 400)
+			return
+		}
+		user.lastActivity = time.Now()
+
+		userStats, _ := calculateRaidStats(user.raidGroup, raidStatsView{})
+		summaries := roles.Summarize(userStats)
+		body, _ := json.Marshal(&summaries)
+		compression.Write(w, r, "application/json", body)
+		return
+	} else if r.Method != "POST" {
+		http.Error(w, "Unsupported method", 404)
+		return
+	}
+
+	// Assigning roles needs the admin password
+	groupId := loginAdmin(params.Get("name"), params.Get("adminPassword"))
+	if groupId == 0 {
+		http.Error(w, "Invalid group name or admin password", 401)
+		return
+	}
+	character := strings.TrimSpace(params.Get("character"))
+	if character == "" {
+		http.Error(w, "Character name required", 400)
+		return
+	}
+
+	// An empty role clears the assignment, leaving the member's own choice
+	role := roles.Normalize(params.Get("role"))
+	if role == roles.Unassigned && params.Get("role") != "" {
+		http.Error(w, "Invalid role", 400)
+		return
+	}
+	err := assignRole(groupId, character, role)
+	if err != nil {
+		log.Printf("Error assigning role: %v", err)
+		http.Error(w, "Error assigning role", 500)
+		return
+	}
+
+	// Update the group if it's active
+	allRaidGroups.RLock()
+	raidGroup := allRaidGroups.raidGroups[groupId]
+	allRaidGroups.RUnlock()
+	if raidGroup != nil {
+		raidGroup.Lock()
+		if role == roles.Unassigned {
+			delete(raidGroup.roles, identity.Key(character))
+		} else {
+			raidGroup.roles[identity.Key(character)] = role
+		}
+		raidGroupChanged(raidGroup)
+		raidGroup.Unlock()
+	}
+	w.Write([]byte("Role assigned successfully"))
+}
+
+// Invite codes let spectators connect without the group password. Managing
+// them needs the admin password.
+func invitesHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	groupId := loginAdmin(params.Get("name"), params.Get("adminPassword"))
+	if groupId == 0 {
+		http.Error(w, "Invalid group name or admin password", 401)
+		return
+	}
+
+	if r.Method == "GET" {
+		invites := loadInvites(groupId)
+		body, _ := json.Marshal(&invites)
+		compression.Write(w, r, "application/json", body)
+	} else if r.Method == "POST" {
+		code := uuid.NewV4().String()
+		_, err := createInviteStmt.Exec(code, groupId, time.Now().Format(time.RFC3339))
+		if err != nil {
+			log.Printf("Error creating invite: %v", err)
+			http.Error(w, "Error creating invite", 500)
+			return
+		}
+		w.Write([]byte(code))
+	} else if r.Method == "DELETE" {
+		// Spectators already connected with the code stay connected
+		qres, _ := deleteInviteStmt.Exec(params.Get("code"), groupId)
+		if qres == nil {
+			http.Error(w, "Delete failed", 500)
+			return
+		}
+		affected, _ := qres.RowsAffected()
+		if affected == 1 {
+			w.Write([]byte("Invite deleted successfully"))
+		} else {
+			http.Error(w, "Invalid invite code", 400)
+		}
+	} else {
+		http.Error(w, "Unsupported method", 404)
+	}
+}
+
+// Shows the server operator which groups would expire, without deleting them.
+// The number of days defaults to GROUP_EXPIRY_DAYS but can be overridden to
+// preview a different setting.
+func expiredGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isOperator(r) {
+		http.Error(w, "Invalid operator key", 401)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Unsupported method", 404)
+		return
+	}
+
+	days := groupExpiryDays
+	if r.URL.Query().Get("days") != "" {
+		var err error
+		days, err = strconv.Atoi(r.URL.Query().Get("days"))
+		if err != nil || days < 1 {
+			http.Error(w, "Invalid days", 400)
+			return
+		}
+	}
+	if days == 0 {
+		http.Error(w, "Group expiry is disabled", 400)
+		return
+	}
+
+	expired, err := expiredGroups(time.Now(), days)
+	if err != nil {
+		log.Printf("Error finding expired groups: %v", err)
+		http.Error(w, "Error finding expired groups", 500)
+		return
+	}
+	body, _ := json.Marshal(&expired)
+	compression.Write(w, r, "application/json", body)
+}
+
+// Lets the server operator see every group with its live session counts,
+// approve or lock groups, and force-delete them
+func groupsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isOperator(r) {
+		http.Error(w, "Invalid operator key", 401)
+		return
+	}
+	params := r.URL.Query()
+
+	if r.Method == "GET" {
+		groups, err := loadRaidGroups()
+		if err != nil {
+			log.Printf("Error loading raid groups: %v", err)
+			http.Error(w, "Error loading raid groups", 500)
+			return
+		}
+
+		// Optionally only groups with a given status, like those waiting
+		// for approval
+		status := params.Get("status")
+		res := make([]OperatorGroup, 0, len(groups))
+		allRaidGroups.RLock()
+		for _, info := range groups {
+			if status != "" && info.Status != status {
+				continue
+			}
+			group := OperatorGroup{RaidGroupInfo:info}
+			if raidGroup := allRaidGroups.raidGroups[info.Id]; raidGroup != nil {
+				raidGroup.RLock()
+				for _, user := range raidGroup.users {
+					if user != nil {
+						group.Members++
+					}
+				}
+				group.Spectators = raidGroup.spectators
+				raidGroup.RUnlock()
+			}
+			res = append(res, group)
+		}
+		allRaidGroups.RUnlock()
+
+		body, _ := json.Marshal(&res)
+		compression.Write(w, r, "application/json", body)
+		return
+	}
+
+	id, err := strconv.ParseUint(params.Get("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid id", 400)
+		return
+	}
+	groupId := uint32(id)
+	info, err := loadRaidGroupInfo(groupId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Raid group not found", 404)
+		return
+	} else if err != nil {
+		log.Printf("Error loading raid group: %v", err)
+		http.Error(w, "Error loading raid group", 500)
+		return
+	}
+
+	if r.Method == "PUT" {
+		// Approve, lock or unlock
+		status := params.Get("status")
+		if status != groupActive && status != groupLocked {
+			http.Error(w, "Invalid status", 400)
+			return
+		}
+		_, err = updateRaidGroupStatusStmt.Exec(status, groupId)
+		if err != nil {
+			log.Printf("Error updating raid group: %v", err)
+			http.Error(w, "Error updating raid group", 500)
+			return
+		}
+
+		// Locking disconnects everyone
+		if status == groupLocked {
+			kicked := kickUsers(groupId, func(user *User) bool { return true })
+			log.Printf("Locked raid group '%s', disconnected %d users", info.Name, kicked)
+		} else {
+			log.Printf("Raid group '%s' is now %s", info.Name, status)
+		}
+		w.Write([]byte("Raid group updated successfully"))
+	} else if r.Method == "DELETE" {
+		err = groupname.Delete(db, groupId)
+		if err != nil {
+			log.Printf("Error deleting raid group: %v", err)
+			http.Error(w, "Error deleting raid group", 500)
+			return
+		}
+		kickUsers(groupId, func(user *User) bool { return true })
+		log.Printf("Force-deleted raid group: '%s'", info.Name)
+		webhooks.Send(groupId, info.Name, webhook.GroupDeleted, GroupEvent{Reason:"operator"})
+		w.Write([]byte("Raid group deleted successfully"))
+	} else {
+		http.Error(w, "Unsupported method", 404)
+	}
+}
+
+// Lists every connected session for the server operator
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isOperator(r) {
+		http.Error(w, "Invalid operator key", 401)
+		return
+	}
+
+	allUsers.RLock()
+	users := make([]*User, 0, len(allUsers.users))
+	for k := range allUsers.users {
+		users = append(users, allUsers.users[k])
+	}
+	allUsers.RUnlock()
+
+	sessions := make([]Session, 0, len(users))
+	for _, user := range users {
+		raidGroup := user.raidGroup
+		if raidGroup == nil {
+			continue
+		}
+		raidGroup.RLock()
+		sessions = append(sessions, Session{
+			GroupId:raidGroup.id,
+			Group:raidGroup.name,
+			RaidUserId:user.stats.RaidUserId,
+			CharacterName:user.stats.CharacterName,
+			Spectator:user.spectator,
+			Connected:user.connected,
+			LastActivity:user.lastActivity,
+		})
+		raidGroup.RUnlock()
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Group != sessions[j].Group {
+			return sessions[i].Group < sessions[j].Group
+		}
+		return sessions[i].Connected.Before(sessions[j].Connected)
+	})
+
+	body, _ := json.Marshal(&sessions)
+	compression.Write(w, r, "application/json", body)
+}
+
+// Lets the group admin see who's connected and kick members
+func membersHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	groupId := loginAdmin(params.Get("name"), params.Get("adminPassword"))
+	if groupId == 0 {
+		http.Error(w, "Invalid group name or admin password", 401)
+		return
+	}
+	allRaidGroups.RLock()
+	raidGroup := allRaidGroups.raidGroups[groupId]
+	allRaidGroups.RUnlock()
+
+	if r.Method == "GET" {
+		now := time.Now()
+		members := make([]Member, 0, 16)
+		if raidGroup != nil {
+			raidGroup.RLock()
+			for i := range raidGroup.users {
+				user := raidGroup.users[i]
+				if user != nil {
+					members = append(members, Member{
+						Id:i,
+						RaidUserId:user.stats.RaidUserId,
+						CharacterName:user.stats.CharacterName,
+						TokenAge:now.Sub(user.connected).Seconds(),
+						LastActivity:user.lastActivity,
+						Verified:user.verified,
+					})
+				}
+			}
+			raidGroup.RUnlock()
+		}
+		body, _ := json.Marshal(&members)
+		compression.Write(w, r, "application/json", body)
+	} else if r.Method == "DELETE" {
+		// Kick member by id
+		id, err := strconv.Atoi(params.Get("id"))
+		if err != nil {
+			http.Error(w, "Invalid id", 400)
+			return
+		}
+		var user *User
+		if raidGroup != nil {
+			raidGroup.RLock()
+			if id >= 0 && id < len(raidGroup.users) {
+				user = raidGroup.users[id]
+			}
+			raidGroup.RUnlock()
+		}
+		if user == nil {
+			http.Error(w, "Member not found", 404)
+			return
+		}
+		allUsers.Lock()
+		removeUser(user)
+		allUsers.Unlock()
+		log.Printf("Kicked %s from raid group %s", user.stats.CharacterName, raidGroup.name)
+		w.Write([]byte("Member kicked successfully"))
+	} else {
+		http.Error(w, "Unsupported method", 404)
+	}
+}
+
+// Bans stop a CharacterName or RaidUserId from sending stats to the group
+func bansHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	groupId := loginAdmin(params.Get("name"), params.Get("adminPassword"))
+	if groupId == 0 {
+		http.Error(w, "Invalid group name or admin password", 401)
+		return
+	}
+
+	if r.Method == "GET" {
+		bans := loadBans(groupId)
+		body, _ := json.Marshal(&bans)
+		compression.Write(w, r, "application/json", body)
+		return
+	} else if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Unsupported method", 404)
+		return
+	}
+
+	// Parse ban
+	var ban Ban
+	ban.CharacterName = params.Get("character")
+	if params.Get("raidUserId") != "" {
+		id, err := strconv.ParseInt(params.Get("raidUserId"), 10, 32)
+		if err != nil || id == 0 {
+			http.Error(w, "Invalid raidUserId", 400)
+			return
+		}
+		ban.RaidUserId = int32(id)
+	}
+	if ban.CharacterName == "" && ban.RaidUserId == 0 {
+		http.Error(w, "Character or raidUserId required", 400)
+		return
+	}
+
+	var err error
+	if r.Method == "POST" {
+		_, err = createBanStmt.Exec(groupId, ban.CharacterName, ban.RaidUserId, time.Now().Format(time.RFC3339))
+	} else {
+		_, err = deleteBanStmt.Exec(groupId, ban.CharacterName, ban.RaidUserId)
+	}
+	if err != nil {
+		log.Printf("Error updating bans: %v", err)
+		http.Error(w, "Error updating bans", 500)
+		return
+	}
+
+	// Update the group if it's active, kicking anyone just banned
+	bans := loadBans(groupId)
+	allRaidGroups.RLock()
+	raidGroup := allRaidGroups.raidGroups[groupId]
+	allRaidGroups.RUnlock()
+	if raidGroup != nil {
+		raidGroup.Lock()
+		raidGroup.bans = bans
+		raidGroup.Unlock()
+	}
+	if r.Method == "POST" {
+		kickUsers(groupId, func(user *User) bool {
+			user.raidGroup.RLock()
+			defer user.raidGroup.RUnlock()
+			return isBanned([]Ban{ban}, user.stats)
+		})
+		w.Write([]byte("Ban added successfully"))
+	} else {
+		w.Write([]byte("Ban removed successfully"))
+	}
+}
+
+// Lists the group's claimed characters, or releases one so a player who has
+// lost their secret can claim it again. Needs the admin password.
+func charactersHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	groupId := loginAdmin(params.Get("name"), params.Get("adminPassword"))
+	if groupId == 0 {
+		http.Error(w, "Invalid group name or admin password", 401)
+		return
+	}
+
+	if r.Method == "GET" {
+		claims, err := identities.List(groupId)
+		if err != nil {
+			log.Printf("Error loading claimed characters: %v", err)
+			http.Error(w, "Error loading claimed characters", 500)
+			return
+		}
+		body, _ := json.Marshal(&claims)
+		compression.Write(w, r, "application/json", body)
+		return
+	} else if r.Method != "DELETE" {
+		http.Error(w, "Unsupported method", 404)
+		return
+	}
+
+	character := params.Get("character")
+	if character == "" {
+		http.Error(w, "Character name required", 400)
+		return
+	}
+	released, err := identities.Release(groupId, character)
+	if err != nil {
+		log.Printf("Error releasing character: %v", err)
+		http.Error(w, "Error releasing character", 500)
+		return
+	}
+	if !released {
+		http.Error(w, "Character has not been claimed", 404)
+		return
+	}
+
+	// Update the group if it's active
+	allRaidGroups.RLock()
+	raidGroup := allRaidGroups.raidGroups[groupId]
+	allRaidGroups.RUnlock()
+	if raidGroup != nil {
+		raidGroup.Lock()
+		delete(raidGroup.claimed, identity.Key(character))
+		raidGroup.Unlock()
+	}
+	w.Write([]byte("Character released successfully"))
+}
+
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	groupId := loginAdmin(params.Get("name"), params.Get("adminPassword"))
+	if groupId == 0 {
+		http.Error(w, "Invalid group name or admin password", 401)
+		return
+	}
+
+	if r.Method == "GET" {
+		hooks, err := webhooks.List(groupId)
+		if err != nil {
+			log.Printf("Error loading webhooks: %v", err)
+			http.Error(w, "Error loading webhooks", 500)
+			return
+		}
+		body, _ := json.Marshal(&hooks)
+		compression.Write(w, r, "application/json", body)
+	} else if r.Method == "POST" {
+		// The secret is only ever returned here
+		events, err := webhook.ParseEvents(params.Get("events"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		hook, err := webhooks.Register(groupId, params.Get("url"), events)
+		if err == webhook.ErrInvalidURL || err == webhook.ErrPrivate || err == webhook.ErrTooMany {
+			http.Error(w, err.Error(), 400)
+			return
+		} else if err != nil {
+			log.Printf("Error registering webhook: %v", err)
+			http.Error(w, "Error registering webhook", 500)
+			return
+		}
+		log.Printf("Registered webhook %d for group %d", hook.Id, groupId)
+		body, _ := json.Marshal(&hook)
+		compression.Write(w, r, "application/json", body)
+	} else if r.Method == "DELETE" {
+		id, err := strconv.ParseInt(params.Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid webhook id", 400)
+			return
+		}
+		deleted, err := webhooks.Delete(groupId, id)
+		if err != nil {
+			log.Printf("Error deleting webhook: %v", err)
+			http.Error(w, "Error deleting webhook", 500)
+			return
+		}
+		if !deleted {
+			http.Error(w, "Webhook not found", 404)
+			return
+		}
+		w.Write([]byte("Webhook deleted successfully"))
+	} else {
+		http.Error(w, "Unsupported method", 404)
+	}
+}
+
+// Sends a ping to a webhook and returns how the delivery went
+func webhookTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Unsupported method", 404)
+		return
+	}
+	params := r.URL.Query()
+	groupId := loginAdmin(params.Get("name"), params.Get("adminPassword"))
+	if groupId == 0 {
+		http.Error(w, "Invalid group name or admin password", 401)
+		return
+	}
+	id, err := strconv.ParseInt(params.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid webhook id", 400)
+		return
+	}
+
+	info, _ := loadRaidGroupInfo(groupId)
+	delivery, err := webhooks.Test(groupId, info.Name, id)
+	if err == webhook.ErrNotFound {
+		http.Error(w, err.Error(), 404)
+		return
+	} else if err != nil {
+		log.Printf("Error testing webhook: %v", err)
+		http.Error(w, "Error testing webhook", 500)
+		return
+	}
+	body, _ := json.Marshal(&delivery)
+	compression.Write(w, r, "application/json", body)
+}
+
+// Lists recent deliveries, for every webhook or just the one given
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Unsupported method", 404)
+		return
+	}
+	params := r.URL.Query()
+	groupId := loginAdmin(params.Get("name"), params.Get("adminPassword"))
+	if groupId == 0 {
+		http.Error(w, "Invalid group name or admin password", 401)
+		return
+	}
+	var id int64
+	if params.Get("id") != "" {
+		var err error
+		id, err = strconv.ParseInt(params.Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid webhook id", 400)
+			return
+		}
+	}
+
+	deliveries, err := webhooks.Deliveries(groupId, id)
+	if err != nil {
+		log.Printf("Error loading webhook deliveries: %v", err)
+		http.Error(w, "Error loading webhook deliveries", 500)
+		return
+	}
+	body, _ := json.Marshal(&deliveries)
+	compression.Write(w, r, "application/json", body)
+}
+
+// Checks that a user may report stats as the character: connections bound to
+// a character can only report as it, and claimed characters need a
+// connection that was verified for them, or their secret. Returns the status
+// and message to refuse with if not.
+func authorizeCharacter(user *User, character string, secret string) (int, string) {
+	user.raidGroup.RLock()
+	bound := user.character
+	verified := user.verified
+	claimed := user.raidGroup.claimed[identity.Key(character)]
+	user.raidGroup.RUnlock()
+	if bound != "" && identity.Key(character) != identity.Key(bound) {
+		return 403, "Connection is bound to character " + bound
+	}
+	if !claimed || verified {
+		return 0, ""
+	}
+
+	// A secret sent with the stats binds the connection to the character
+	if secret != "" {
+		_, err := identities.Verify(user.raidGroup.id, character, secret)
+		if err == nil {
+			user.raidGroup.Lock()
+			user.character = character
+			user.verified = true
+			user.raidGroup.Unlock()
+			return 0, ""
+		} else if err != identity.ErrWrongSecret {
+			log.Printf("Error verifying character: %v", err)
+			return 500, "Error verifying character"
+		}
+	}
+	return 403, "Character has been claimed, connect with its secret"
+}
+
+// Disconnects the user if the character or id they've reported as is banned,
+// returning whether they were
+func disconnectIfBanned(user *User, userStats stats.UserStats) bool {
+	user.raidGroup.RLock()
+	banned := isBanned(user.raidGroup.bans, userStats)
+	user.raidGroup.RUnlock()
+	if banned {
+		allUsers.Lock()
+		removeUser(user)
+		allUsers.Unlock()
+	}
+	return banned
+}
+
+func isBanned(bans []Ban, userStats stats.UserStats) bool {
+	for _, ban := range bans {
+		if ban.CharacterName != "" && identity.Key(ban.CharacterName) == identity.Key(userStats.CharacterName) {
+			return true
+		}
+		if ban.RaidUserId != 0 && ban.RaidUserId == userStats.RaidUserId {
+			return true
+		}
+	}
+	return false
+}
+
+func loadInvites(groupId uint32) []Invite {
+	invites := make([]Invite, 0, 4)
+	rows, err := selectInvitesStmt.Query(groupId)
+	if err != nil {
+		log.Printf("Error loading invites: %v", err)
+		return invites
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var invite Invite
+		if rows.Scan(&invite.Code, &invite.Created) == nil {
+			invites = append(invites, invite)
+		}
+	}
+	return invites
+}
+
+func loadBans(groupId uint32) []Ban {
+	bans := make([]Ban, 0, 4)
+	rows, err := selectBansStmt.Query(groupId)
+	if err != nil {
+		log.Printf("Error loading bans: %v", err)
+		return bans
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ban Ban
+		if rows.Scan(&ban.CharacterName, &ban.RaidUserId, &ban.Created) == nil {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+// Loads the keys of the group's claimed characters
+func loadClaims(groupId uint32) map[string]bool {
+	claimed := map[string]bool{}
+	claims, err := identities.List(groupId)
+	if err != nil {
+		log.Printf("Error loading claimed characters: %v", err)
+		return claimed
+	}
+	for _, claim := range claims {
+		claimed[identity.Key(claim.CharacterName)] = true
+	}
+	return claimed
+}
+
+// Loads the roles the group admin has assigned, by character name
+func loadRoles(groupId uint32) map[string]string {
+	groupRoles := map[string]string{}
+	rows, err := selectRolesStmt.Query(groupId)
+	if err != nil {
+		log.Printf("Error loading roles: %v", err)
+		return groupRoles
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var character, role string
+		if rows.Scan(&character, &role) == nil {
+			groupRoles[character] = role
+		}
+	}
+	return groupRoles
+}
+
+// Rekeys roles loaded by character name by the name's identity.Key, so they
+// match however members type it
+func keyRoles(groupRoles map[string]string) map[string]string {
+	keyed := make(map[string]string, len(groupRoles))
+	for character, role := range groupRoles {
+		keyed[identity.Key(character)] = role
+	}
+	return keyed
+}
+
+// Saves or clears the role assigned to a character, replacing any assignment
+// under another spelling of their name
+func assignRole(groupId uint32, character string, role string) error {
+	groupRoles := loadRoles(groupId)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for name := range groupRoles {
+		if identity.Key(name) == identity.Key(character) {
+			_, err = tx.Stmt(deleteRoleStmt).Exec(groupId, name)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	if role != roles.Unassigned {
+		_, err = tx.Stmt(upsertRoleStmt).Exec(groupId, character, role)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func parseIds(values []string) ([]int32, error) {
+	ids := make([]int32, 0, len(values))
+	for _, value := range values {
+		id, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, int32(id))
+	}
+	return ids, nil
+}
+
+func isOperator(r *http.Request) bool {
+	if operatorKey == "" {
+		return false
+	}
+	key := r.Header.Get("X-Operator-Key")
+	return subtle.ConstantTimeCompare([]byte(key), []byte(operatorKey)) == 1
+}
+
+func findUser(tokenStr string) *User {
+	token, _ := uuid.FromString(tokenStr)
+	allUsers.RLock()
+	user := allUsers.users[token]
+	allUsers.RUnlock()
+	return user
+}
+
+func loginAdmin(group string, adminPassword string) uint32 {
+	var id uint32
+	selectRaidGroupAdminStmt.QueryRow(groupname.Key(group), group, adminPassword).Scan(&id)
+	return id
+}
+
+func loginRaid(group string, password string) uint32 {
+	var id uint32
+	var groupPassword string
+	selectActiveRaidGroupStmt.QueryRow(groupname.Key(group), group).Scan(&id, &groupPassword)
+	if password == groupPassword {
+		return id
+	} else {
+		return 0
+	}
+}
+
+// Returns the serialized stats response for the raid group along with the
+// group version it was built from, reusing the cached copy if possible
+func cachedRaidStats(raidGroup *RaidGroup, format string, acceptEncoding string, view raidStatsView) (*cachedResponse, uint64) {
+	raidGroup.cacheLock.Lock()
+	defer raidGroup.cacheLock.Unlock()
+
+	// Check cache
+	raidGroup.RLock()
+	version := raidGroup.version
+	raidGroup.RUnlock()
+	key := format + "|" + compression.Key(acceptEncoding) + "|" + view.key()
+	if version == raidGroup.cacheVersion {
+		res := raidGroup.cache[key]
+		if res != nil {
+			return res, version
+		}
+	}
+
+	// Build response
+	raidGroupStats, version := calculateRaidStats(raidGroup, view)
+	body, _ := stats.MarshalList(format, raidGroupStats)
+	encoding := compression.Choose(acceptEncoding, len(body))
+	compressed, err := compression.Encode(encoding, body)
+	if err != nil {
+		// WriteEncoded turns NotAcceptable into a 406
+		if encoding != compression.NotAcceptable {
+			encoding = compression.Identity
+		}
+		compressed = body
+	}
+	res := &cachedResponse{contentType:format, encoding:encoding, body:compressed}
+
+	// Save it for the next request
+	if version != raidGroup.cacheVersion || raidGroup.cache == nil {
+		raidGroup.cacheVersion = version
+		raidGroup.cache = map[string]*cachedResponse{}
+	}
+	raidGroup.cache[key] = res
+
+	return res, version
+}
+
+// Overwrites the client-reported totals with those computed from the
+// user's combat log
+func applyCombatLogTotals(userStats *stats.UserStats, totals combatlog.Totals) {
+	userStats.DamageOut        = totals.DamageOut
+	userStats.DamageIn         = totals.DamageIn
+	userStats.HealOut          = totals.HealOut
+	userStats.EffectiveHealOut = totals.EffectiveHealOut
+	userStats.HealIn           = totals.HealIn
+	userStats.Threat           = totals.Threat
+	userStats.CombatTicks      = totals.CombatTicks
+	userStats.CombatStart      = stats.RFC3339NanoTime{Time:totals.CombatStart.UTC()}
+	userStats.CombatEnd        = stats.RFC3339NanoTime{Time:totals.CombatEnd.UTC()}
+}
+
+// Adds the user's current totals to their encounter history. Snapshots are
+// timed by the client's clock, like CombatStart, from their last combat update
+// or else how long they've been in combat. Must be called with the raid
+// group's write lock held.
+func recordHistory(user *User) {
+	combatStart := user.stats.CombatStart.Time
+	if combatStart.IsZero() {
+		return
+	}
+	at := user.stats.LastCombatUpdate.Time
+	if at.Before(combatStart) {
+		at = combatStart.Add(stats.TicksDuration(user.stats.CombatTicks))
+	}
+	if user.history == nil {
+		user.history = history.NewRing(historyCapacity)
+	}
+	user.history.Add(combatStart, history.Snapshot{
+		Time:at,
+		DamageOut:user.stats.DamageOut,
+		DamageIn:user.stats.DamageIn,
+		HealOut:user.stats.HealOut,
+		EffectiveHealOut:user.stats.EffectiveHealOut,
+		HealIn:user.stats.HealIn,
+		Threat:user.stats.Threat,
+	})
+}
+
+// Keeps track of the encounter the user is in, returning their final stats
+// for one that's just finished. Must be called with the raid group's write
+// lock held.
+func trackEncounter(user *User, now time.Time) *stats.UserStats {
+	current := user.stats
+	pending := user.pendingEncounter
+
+	// A new encounter started before we saw the last one end
+	if pending != nil && !pending.CombatStart.Equal(current.CombatStart.Time) {
+		user.pendingEncounter = nil
+		if current.RaidEncounterId != 0 && !current.CombatStart.IsZero() {
+			user.pendingEncounter = &current
+		}
+		return pending
+	}
+
+	if current.RaidEncounterId == 0 || current.CombatStart.IsZero() {
+		user.pendingEncounter = nil
+		return nil
+	}
+	if polling.InCombat(current.CombatStart.Time, current.CombatEnd.Time, now) {
+		user.pendingEncounter = &current
+		return nil
+	}
+
+	// Out of combat, so the encounter is over
+	user.pendingEncounter = nil
+	if pending != nil {
+		return &current
+	}
+	return nil
+}
+
+// Saves a finished encounter to the leaderboards, flagging it if the numbers
+// look implausible
+func recordEncounter(raidGroup *RaidGroup, user *User, finished stats.UserStats) {
+	if finished.CharacterName == "" {
+		return
+	}
+	result := leaderboard.ResultFromStats(finished)
+	if result.Duration < leaderboard.MinDuration {
+		return
+	}
+	raidGroup.RLock()
+	decreased := finished.CombatStart.Equal(user.resetStart)
+	raidGroup.RUnlock()
+	history, err := leaderboards.Distribution(result.EncounterKey)
+	if err != nil {
+		log.Printf("Error loading encounter history: %v", err)
+	}
+	result.Flags = anomaly.Score(result, history, decreased)
+	if len(result.Flags) > 0 {
+		log.Printf("Flagged encounter for %s in %s: %s", finished.CharacterName, raidGroup.name, strings.Join(result.Flags, ", "))
+	}
+
+	newBests, err := leaderboards.Record(raidGroup.id, result)
+	if err == leaderboard.ErrTooShort {
+		return
+	} else if err != nil {
+		log.Printf("Error recording encounter: %v", err)
+		return
+	}
+
+	// There's no telling whose numbers are wrong if the group did more damage
+	// than the boss has health, so the whole fight is flagged
+	health := encounterCatalog.Health(result.RaidEncounterId, result.RaidEncounterMode)
+	if health > 0 {
+		damage, err := leaderboards.FightDamage(raidGroup.id, result.EncounterKey, result.CombatStart)
+		if err == nil && anomaly.ExceedsHealth(damage, health) {
+			flagged, err := leaderboards.FlagFight(raidGroup.id, result.EncounterKey, result.CombatStart, anomaly.BossHealth)
+			if err != nil {
+				log.Printf("Error flagging fight: %v", err)
+			} else if flagged > 0 {
+				log.Printf("Flagged fight in %s: %d damage against %d health", raidGroup.name, damage, health)
+			}
+			return
+		}
+	}
+	if len(newBests) > 0 {
+		log.Printf("New personal best for %s in %s: %v", finished.CharacterName, raidGroup.name, newBests)
+		resolved := encounterCatalog.Resolve(result.RaidEncounterId, result.RaidEncounterMode, result.RaidEncounterPlayers)
+		notify(raidGroup, webhook.PersonalBest, PersonalBestEvent{Result:result, Resolved:resolved, Metrics:newBests})
+	}
+}
+
+// Notices the group starting and finishing encounters, from the encounters
+// its members are in, adding a member's final stats for one to the fight's
+// results. Must be called with the raid group's write lock held.
+func trackFight(raidGroup *RaidGroup, finished *stats.UserStats) {
+	fight := raidGroup.fight
+	if fight != nil && finished != nil && fight.includes(finished) {
+		fight.results = append(fight.results, *finished)
+		if finished.CombatEnd.After(fight.end) {
+			fight.end = finished.CombatEnd.Time
+		}
+	}
+
+	// The fight goes on as long as anyone is still in it
+	var next *stats.UserStats
+	for _, user := range raidGroup.users {
+		if user == nil || user.pendingEncounter == nil {
+			continue
+		}
+		if fight != nil && fight.includes(user.pendingEncounter) {
+			return
+		}
+		if next == nil {
+			next = user.pendingEncounter
+		}
+	}
+
+	if fight != nil {
+		raidGroup.fight = nil
+		if fight.end.IsZero() {
+			fight.end = time.Now()
+		}
+		notify(raidGroup, webhook.EncounterEnded, EncounterEndedEvent{EncounterEvent:fight.event(), CombatEnd:fight.end, Results:fight.results})
+	}
+	if next != nil {
+		fight = &groupFight{key:leaderboard.ResultFromStats(*next).EncounterKey, start:next.CombatStart.Time}
+		raidGroup.fight = fight
+		notify(raidGroup, webhook.EncounterStarted, fight.event())
+	}
+}
+
+// Returns whether a member's encounter is part of the fight
+func (f *groupFight) includes(userStats *stats.UserStats) bool {
+	if userStats.RaidEncounterId != f.key.RaidEncounterId || userStats.RaidEncounterMode != f.key.RaidEncounterMode {
+		return false
+	}
+	difference := userStats.CombatStart.Sub(f.start)
+	return difference <= leaderboard.FightWindow && difference >= -leaderboard.FightWindow
+}
+
+func (f *groupFight) event() EncounterEvent {
+	resolved := encounterCatalog.Resolve(f.key.RaidEncounterId, f.key.RaidEncounterMode, f.key.RaidEncounterPlayers)
+	return EncounterEvent{EncounterKey:f.key, Resolved:resolved, CombatStart:f.start}
+}
+
+// Webhooks can only reach public addresses unless the operator allows private
+// ones, for receivers on the server's own network
+func newWebhookDispatcher() *webhook.Dispatcher {
+	dispatcher, err := webhook.NewDispatcher(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dispatcher.AllowPrivate = os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+	return dispatcher
+}
+
+// Notifies the group's webhooks of an event
+func notify(raidGroup *RaidGroup, event string, data interface{}) {
+	webhooks.Send(raidGroup.id, raidGroup.name, event, data)
+}
+
+// Returns the minimum number of seconds between polls for the raid group
+func raidGroupPollingRate(raidGroup *RaidGroup) uint32 {
+	now := time.Now()
+	size := 0
+	inCombat := false
+	raidGroup.RLock()
+	for i := range raidGroup.users {
+		user := raidGroup.users[i]
+		if user != nil {
+			size++
+			if polling.InCombat(user.stats.CombatStart.Time, user.stats.CombatEnd.Time, now) {
+				inCombat = true
+			}
+		}
+	}
+	raidGroup.RUnlock()
+
+	return pollLimiter.Rate(size, inCombat)
+}
+
+// Must be called with the raid group's write lock held
+func raidGroupChanged(raidGroup *RaidGroup) {
+	raidGroup.version++
+	close(raidGroup.changed)
+	raidGroup.changed = make(chan struct{})
+}
+
+// Blocks until the raid group is newer than the given version, the wait
+// elapses, or done is closed
+func waitForRaidStats(raidGroup *RaidGroup, since uint64, wait time.Duration, done <-chan struct{}) {
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		raidGroup.RLock()
+		version := raidGroup.version
+		changed := raidGroup.changed
+		raidGroup.RUnlock()
+		if version > since {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// Accepts either a duration ("30s") or a number of seconds ("30"), capped at
+// maxStatsWait
+func parseStatsWait(value string) (time.Duration, error) {
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		wait = time.Duration(seconds)*time.Second
+	}
+	if wait < 0 {
+		wait = 0
+	} else if wait > maxStatsWait {
+		wait = maxStatsWait
+	}
+	return wait, nil
+}
+
+// Reads the whole request body, responding with an error if it can't be read
+// or is larger than limit
+func readRequestBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, bool) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Request body larger than %d bytes", limit), 413)
+		} else {
+			http.Error(w, "Error reading request", 400)
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+// The group's epoch keeps a tag from before the group was last unloaded, or
+// the server restarted, from matching once version has started over. The view
+// is hashed since its roles are comma separated, like If-None-Match's tags.
+func raidStatsETag(raidGroup *RaidGroup, version uint64, format string, view raidStatsView) string {
+	return fmt.Sprintf(`W/"%s-%d-%s-%08x"`, raidGroup.epoch, version, strings.TrimPrefix(format, "application/"), crc32.ChecksumIEEE([]byte(view.key())))
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func calculateRaidStats(raidGroup *RaidGroup, view raidStatsView) ([]stats.UserStats, uint64) {
+	// Pull out all active user stats
 	raidGroup.RLock()
+	version := raidGroup.version
 	userCount := len(raidGroup.users)
-	userStats := make([]UserStats, 0, userCount)
+	userStats := make([]stats.UserStats, 0, userCount)
 	for i := 0; i < userCount; i++ {
 		if raidGroup.users[i] != nil {
 			userStats = append(userStats, raidGroup.users[i].stats)
 		}
 	}
+
+	// Roles assigned by the group admin take precedence over self-declared ones
+	for i := range userStats {
+		if role, ok := raidGroup.roles[identity.Key(userStats[i].CharacterName)]; ok {
+			userStats[i].Role = role
+		}
+	}
 	raidGroup.RUnlock()
 
 	// Post-process...
+	if len(view.roles) > 0 {
+		userStats = roles.Filter(userStats, view.roles)
+	}
+	if view.sortByRole {
+		roles.Sort(userStats)
+	}
+
+	return userStats, version
+}
+
+// Roles to filter the group's stats to and whether to sort them by role
+type raidStatsView struct {
+	roles []string
+	sortByRole bool
+}
+
+func (v raidStatsView) key() string {
+	return fmt.Sprintf("%s|%t", strings.Join(v.roles, ","), v.sortByRole)
+}
+
+// Parses the role and sort query params. Roles may be repeated or comma
+// separated.
+func parseRaidStatsView(params url.Values) (raidStatsView, error) {
+	var view raidStatsView
+	var values []string
+	for _, value := range params["role"] {
+		values = append(values, strings.Split(value, ",")...)
+	}
+	var ok bool
+	view.roles, ok = roles.Parse(values)
+	if !ok {
+		return view, fmt.Errorf("Invalid role")
+	}
+	switch params.Get("sort") {
+	case "":
+	case "role":
+		view.sortByRole = true
+	default:
+		return view, fmt.Errorf("Invalid sort")
+	}
+	return view, nil
+}
+
+func finishedEncounters(now time.Time) {
+	allUsers.RLock()
+	users := make([]*User, 0, len(allUsers.users))
+	for k := range allUsers.users {
+		users = append(users, allUsers.users[k])
+	}
+	allUsers.RUnlock()
+
+	for i := range users {
+		user := users[i]
+		raidGroup := user.raidGroup
+		if raidGroup == nil {
+			continue
+		}
+
+		raidGroup.Lock()
+		pending := user.pendingEncounter
+		inactive := now.Sub(user.lastActivity) > inactiveTimeoutDuration
+		if pending != nil && (inactive || !polling.InCombat(pending.CombatStart.Time, pending.CombatEnd.Time, now)) {
+			user.pendingEncounter = nil
+			trackFight(raidGroup, pending)
+		} else {
+			pending = nil
+		}
+		raidGroup.Unlock()
+
+		if pending != nil {
+			recordEncounter(raidGroup, user, *pending)
+		}
+	}
+}
+
+// Returns the groups that haven't been used in the given number of days.
+// Groups with anyone connected are never expired.
+func expiredGroups(now time.Time, days int) ([]ExpiredGroup, error) {
+	cutoff := now.AddDate(0, 0, -days)
+	rows, err := selectRaidGroupsUsedStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	expired := make([]ExpiredGroup, 0, 16)
+	for rows.Next() {
+		var group ExpiredGroup
+		var lastUsed sql.NullString
+		err = rows.Scan(&group.Id, &group.Name, &lastUsed)
+		if err != nil {
+			return nil, err
+		}
+		group.LastUsed = lastUsed.String
+
+		// Never expire a group we can't tell the age of
+		used, err := time.Parse(time.RFC3339, lastUsed.String)
+		if err != nil || used.After(cutoff) {
+			continue
+		}
+		allRaidGroups.RLock()
+		active := allRaidGroups.raidGroups[group.Id] != nil
+		allRaidGroups.RUnlock()
+		if !active {
+			expired = append(expired, group)
+		}
+	}
+	return expired, rows.Err()
+}
+
+// Removes a user from their raid group and the user store, invalidating their
+// token. Returns false if they were already removed. Must be called with
+// allUsers' write lock held.
+func removeUser(user *User) bool {
+	if allUsers.users[user.token] != user {
+		return false
+	}
+
+	// Remove from raid group
+	raidGroup := user.raidGroup
+	raidGroup.Lock()
+	if user.spectator {
+		raidGroup.spectators--
+	} else {
+		groupUsers := raidGroup.users
+		for j := range groupUsers {
+			if groupUsers[j] == user {
+				groupUsers[j] = nil
+				break
+			}
+		}
+		raidGroupChanged(raidGroup)
+
+		// Leaving can end the group's fight
+		trackFight(raidGroup, nil)
+		member := MemberEvent{RaidUserId:user.stats.RaidUserId, CharacterName:user.stats.CharacterName, Verified:user.verified, Connected:user.connected}
+		if member.CharacterName == "" {
+			member.CharacterName = user.character
+		}
+		notify(raidGroup, webhook.MemberDisconnected, member)
+	}
+	raidGroup.Unlock()
+
+	// Remove from users store
+	delete(allUsers.users, user.token)
+	return true
+}
 
-	return userStats
+// Disconnects every user in the group that matches, including spectators,
+// returning how many were disconnected
+func kickUsers(groupId uint32, matches func(*User) bool) int {
+	kicked := 0
+	allUsers.Lock()
+	for _, user := range allUsers.users {
+		if user.raidGroup != nil && user.raidGroup.id == groupId && matches(user) && removeUser(user) {
+			kicked++
+		}
+	}
+	allUsers.Unlock()
+	return kicked
 }
 
 func garbageCollectInactive() {
 	tick := time.Tick(gcCheckFrequency)
+	var lastExpiry, lastPrune time.Time
 	for {
 		<-tick
 
 		now := time.Now()
 
+		// Delete groups that haven't been used in a long time
+		if groupExpiryDays > 0 && now.Sub(lastExpiry) > expiryCheckFrequency {
+			lastExpiry = now
+			expired, err := expiredGroups(now, groupExpiryDays)
+			if err != nil {
+				log.Printf("Error finding expired groups: %v", err)
+			}
+			for _, group := range expired {
+				err = groupname.Delete(db, group.Id)
+				if err != nil {
+					log.Printf("Error deleting expired group %s: %v", group.Name, err)
+				} else {
+					log.Printf("Deleted expired raid group: '%s' (last used %s)", group.Name, group.LastUsed)
+					webhooks.Send(group.Id, group.Name, webhook.GroupDeleted, GroupEvent{Reason:"expired"})
+				}
+			}
+		}
+
+		// Forget old webhook deliveries
+		if now.Sub(lastPrune) > expiryCheckFrequency {
+			lastPrune = now
+			pruned, err := webhooks.Prune(now.Add(-webhookDeliveryRetention))
+			if err != nil {
+				log.Printf("Error pruning webhook deliveries: %v", err)
+			} else if pruned > 0 {
+				log.Printf("Pruned %d webhook deliveries", pruned)
+			}
+		}
+
 		// Build list of inactive users
 		inactiveUsers := make([]*User, 0, 32)
 		allUsers.RLock()
@@ -315,6 +3206,13 @@ func garbageCollectInactive() {
 		}
 		allUsers.RUnlock()
 
+		// Forget polling history for clients that have gone away
+		pollLimiter.Prune(inactiveTimeoutDuration)
+
+		// Record encounters for users that stopped sending stats after combat
+		// ended, or that are about to be removed
+		finishedEncounters(now)
+
 		// Continue if no inactive users
 		if len(inactiveUsers) == 0 {
 			continue
@@ -326,20 +3224,9 @@ func garbageCollectInactive() {
 		for i := range inactiveUsers {
 			user := inactiveUsers[i]
 
-			// Remove from raid group
-			user.raidGroup.Lock()
-			groupUsers := user.raidGroup.users
-			for j := range groupUsers {
-				if groupUsers[j] == user {
-					groupUsers[j] = nil
-					break
-				}
+			if removeUser(user) {
+				user.raidGroup = nil
 			}
-			user.raidGroup.Unlock()
-			user.raidGroup = nil
-
-			// Remove from users store
-			delete(allUsers.users, user.token)
 		}
 		allUsers.Unlock()
 
@@ -347,9 +3234,9 @@ func garbageCollectInactive() {
 		inactiveRaidGroups := make([]*RaidGroup, 0, 32)
 		allRaidGroups.RLock()
 		for k := range allRaidGroups.raidGroups {
-			active := false
 			raidGroup := allRaidGroups.raidGroups[k]
 			raidGroup.RLock()
+			active := raidGroup.spectators > 0
 			for j := range raidGroup.users {
 				if raidGroup.users[j] != nil {
 					active = true
@@ -360,6 +3247,7 @@ func garbageCollectInactive() {
 
 			if !active {
 				log.Printf("Raid group %s inactive", raidGroup.name)
+				updateRaidGroupUsedStmt.Exec(now.Format(time.RFC3339), raidGroup.id)
 				inactiveRaidGroups = append(inactiveRaidGroups, raidGroup)
 			}
 		}
@@ -377,17 +3265,3 @@ func garbageCollectInactive() {
 		log.Printf("GC run completed in %d ms", int64(time.Since(now) / time.Millisecond))
 	}
 }
-
-// Serialize and deserialize time to reduce memory
-const RFC3339NanoJSON = `"`+time.RFC3339Nano+`"`
-func (t RFC3339NanoTime) MarshalJSON() ([]byte, error) {
-	return []byte(t.Format(RFC3339NanoJSON)), nil
-}
-func (t *RFC3339NanoTime) UnmarshalJSON(data []byte) error {
-	realTime, err := time.Parse(RFC3339NanoJSON, string(data[:]))
-	if err != nil {
-		return err
-	}
-	*t = RFC3339NanoTime{realTime}
-	return nil
-}
\ No newline at end of file
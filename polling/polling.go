@@ -0,0 +1,139 @@
+// Package polling decides how often clients may poll for raid stats, based on
+// server load and what the raid group is doing, and throttles clients that
+// poll faster than they've been told to.
+package polling
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// Polling rates, in seconds between requests
+	CombatRate = 1
+	IdleRate   = 3
+	MaxRate    = 10
+
+	// Groups larger than this produce big payloads, so poll less often
+	LargeGroupSize = 16
+
+	// Server-wide requests per second at which every group is slowed down
+	BusyRequestRate       = 500
+	OverloadedRequestRate = 2000
+
+	// Combat is assumed to still be going on if the last combat update was
+	// this recent, as clients don't clear CombatEnd until combat is over
+	CombatGracePeriod = 15 * time.Second
+
+	// Fraction of the advertised rate a client may poll at before being
+	// throttled, to allow for network jitter
+	throttleTolerance = 0.8
+)
+
+type Limiter struct {
+	sync.Mutex
+	windowStart time.Time
+	windowCount int
+	requestRate int // Requests seen during the last full second
+	lastSeen    map[string]time.Time
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{windowStart: time.Now(), lastSeen: map[string]time.Time{}}
+}
+
+// Record counts a request towards the server-wide request rate
+func (l *Limiter) Record() {
+	l.Lock()
+	l.record(time.Now())
+	l.Unlock()
+}
+
+func (l *Limiter) record(now time.Time) {
+	elapsed := now.Sub(l.windowStart)
+	if elapsed >= time.Second {
+		if elapsed < 2*time.Second {
+			l.requestRate = l.windowCount
+		} else {
+			l.requestRate = 0
+		}
+		l.windowStart = now
+		l.windowCount = 0
+	}
+	l.windowCount++
+}
+
+// RequestRate returns the number of requests seen during the last second
+func (l *Limiter) RequestRate() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.requestRate
+}
+
+// Rate returns the minimum number of seconds between polls for a raid group
+func (l *Limiter) Rate(groupSize int, inCombat bool) uint32 {
+	rate := uint32(IdleRate)
+	if inCombat {
+		rate = CombatRate
+	}
+	if groupSize > LargeGroupSize {
+		rate++
+	}
+
+	requestRate := l.RequestRate()
+	if requestRate >= OverloadedRequestRate {
+		rate *= 4
+	} else if requestRate >= BusyRequestRate {
+		rate *= 2
+	}
+
+	if rate > MaxRate {
+		rate = MaxRate
+	}
+	return rate
+}
+
+// Allow records a poll from the given client and reports whether it came
+// soon enough after the previous one to be throttled. If so, it returns how
+// long the client should wait before trying again.
+func (l *Limiter) Allow(client string, rate uint32) (bool, time.Duration) {
+	now := time.Now()
+	minInterval := time.Duration(float64(rate) * throttleTolerance * float64(time.Second))
+
+	l.Lock()
+	defer l.Unlock()
+	l.record(now)
+	last, ok := l.lastSeen[client]
+	if ok && now.Sub(last) < minInterval {
+		return false, minInterval - now.Sub(last)
+	}
+	l.lastSeen[client] = now
+	return true, 0
+}
+
+// Prune forgets clients that haven't polled within maxAge
+func (l *Limiter) Prune(maxAge time.Duration) {
+	now := time.Now()
+	l.Lock()
+	for client, last := range l.lastSeen {
+		if now.Sub(last) > maxAge {
+			delete(l.lastSeen, client)
+		}
+	}
+	l.Unlock()
+}
+
+// InCombat guesses whether a player is in combat from their reported combat
+// start and end times
+func InCombat(start time.Time, end time.Time, now time.Time) bool {
+	if start.IsZero() {
+		return false
+	}
+	return end.Before(start) || now.Sub(end) < CombatGracePeriod
+}
+
+// RetryAfter formats a wait as whole seconds for the Retry-After header
+func RetryAfter(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
@@ -0,0 +1,124 @@
+// Package roles groups raid members by what they do in the raid, so overlays
+// can show the numbers that matter for each: damage taken and threat for
+// tanks, effective healing for healers, and damage for everyone else.
+package roles
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/warhammerkid/parsec-go/stats"
+)
+
+const (
+	Tank       = "tank"
+	Healer     = "healer"
+	DPS        = "dps"
+	Unassigned = ""
+)
+
+// Roles in the order members are sorted by
+var All = []string{Tank, Healer, DPS}
+
+// Totals for every member with a role
+type Summary struct {
+	Role             string
+	Members          int
+	DamageOut        int64
+	DamageIn         int64
+	HealOut          int64
+	EffectiveHealOut int64
+	HealIn           int64
+	Threat           int64
+	OverhealPercent  float64 // Share of HealOut that wasn't effective
+}
+
+// Normalize returns the canonical name for a role, accepting a few common
+// alternatives, or Unassigned if it isn't one
+func Normalize(role string) string {
+	switch strings.ToLower(strings.TrimSpace(role)) {
+	case "tank":
+		return Tank
+	case "healer", "heal", "heals":
+		return Healer
+	case "dps", "damage":
+		return DPS
+	}
+	return Unassigned
+}
+
+// Parse normalizes a list of roles, returning false if any aren't valid
+func Parse(values []string) ([]string, bool) {
+	parsed := make([]string, 0, len(values))
+	for _, value := range values {
+		role := Normalize(value)
+		if role == Unassigned {
+			return nil, false
+		}
+		parsed = append(parsed, role)
+	}
+	return parsed, true
+}
+
+func rank(role string) int {
+	for i := range All {
+		if All[i] == role {
+			return i
+		}
+	}
+	return len(All)
+}
+
+// Sort orders members tanks first, then healers, then DPS, then anyone
+// without a role, keeping the existing order within each role
+func Sort(users []stats.UserStats) {
+	sort.SliceStable(users, func(i, j int) bool {
+		return rank(users[i].Role) < rank(users[j].Role)
+	})
+}
+
+// Filter returns only the members with one of the given roles
+func Filter(users []stats.UserStats, roles []string) []stats.UserStats {
+	filtered := make([]stats.UserStats, 0, len(users))
+	for i := range users {
+		for _, role := range roles {
+			if users[i].Role == role {
+				filtered = append(filtered, users[i])
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// Summarize totals members by role. Every role is included even if nobody has
+// it, while members without a role are only included if there are any.
+func Summarize(users []stats.UserStats) []Summary {
+	summaries := make([]Summary, len(All)+1)
+	for i := range All {
+		summaries[i].Role = All[i]
+	}
+	summaries[len(All)].Role = Unassigned
+
+	for i := range users {
+		s := &summaries[rank(users[i].Role)]
+		s.Members++
+		s.DamageOut += users[i].DamageOut
+		s.DamageIn += users[i].DamageIn
+		s.HealOut += users[i].HealOut
+		s.EffectiveHealOut += users[i].EffectiveHealOut
+		s.HealIn += users[i].HealIn
+		s.Threat += users[i].Threat
+	}
+
+	for i := range summaries {
+		s := &summaries[i]
+		if s.HealOut > 0 {
+			s.OverhealPercent = float64(s.HealOut-s.EffectiveHealOut) / float64(s.HealOut) * 100
+		}
+	}
+	if summaries[len(All)].Members == 0 {
+		summaries = summaries[:len(All)]
+	}
+	return summaries
+}
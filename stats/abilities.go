@@ -0,0 +1,114 @@
+package stats
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+type AbilityStats struct {
+	AbilityId             int64
+	AbilityName           string
+	Hits                  int32
+	Crits                 int32
+	Total                 int64
+	Max                   int64
+}
+
+// Per-ability numbers for a single encounter. Clients report these
+// cumulatively for the encounter, just like the totals in UserStats.
+type AbilityBreakdown struct {
+	DamageOut             []AbilityStats
+	HealOut               []AbilityStats
+	DamageIn              []AbilityStats
+}
+
+// Body of a stats POST, which may optionally include an ability breakdown.
+// Breakdowns are only accepted in JSON.
+type StatsUpdate struct {
+	UserStats
+	Abilities             *AbilityBreakdown `json:",omitempty"`
+}
+
+// A group member's breakdown for their current encounter
+type UserAbilities struct {
+	RaidUserId            int32
+	CharacterName         string
+	CombatStart           RFC3339NanoTime
+	AbilityBreakdown
+}
+
+// UnmarshalUpdate decodes a stats POST body in the given format
+func UnmarshalUpdate(format string, data []byte, u *StatsUpdate) error {
+	if format == JSON {
+		return json.Unmarshal(data, u)
+	}
+	return Unmarshal(format, data, &u.UserStats)
+}
+
+// Merge folds a newer report for the same encounter into the breakdown.
+// Abilities are matched by id and replaced, so clients only need to send the
+// abilities that changed. Each list keeps at most MaxAbilities, dropping the
+// smallest.
+func (b *AbilityBreakdown) Merge(update *AbilityBreakdown) {
+	b.DamageOut = mergeAbilities(b.DamageOut, update.DamageOut)
+	b.HealOut = mergeAbilities(b.HealOut, update.HealOut)
+	b.DamageIn = mergeAbilities(b.DamageIn, update.DamageIn)
+}
+
+// Copy returns a deep copy, safe to hand out while the original keeps being
+// merged into
+func (b *AbilityBreakdown) Copy() AbilityBreakdown {
+	return AbilityBreakdown{
+		DamageOut: append([]AbilityStats{}, b.DamageOut...),
+		HealOut:   append([]AbilityStats{}, b.HealOut...),
+		DamageIn:  append([]AbilityStats{}, b.DamageIn...),
+	}
+}
+
+func mergeAbilities(existing []AbilityStats, update []AbilityStats) []AbilityStats {
+	if len(update) == 0 {
+		return existing
+	}
+
+	index := make(map[int64]int, len(existing))
+	for i := range existing {
+		index[existing[i].AbilityId] = i
+	}
+	for _, ability := range update {
+		if i, ok := index[ability.AbilityId]; ok {
+			existing[i] = ability
+		} else {
+			index[ability.AbilityId] = len(existing)
+			existing = append(existing, ability)
+		}
+	}
+
+	// Biggest contributors first
+	sort.SliceStable(existing, func(i, j int) bool {
+		return existing[i].Total > existing[j].Total
+	})
+
+	// Each report is capped, but they can add up to more, so only keep the
+	// biggest contributors
+	if len(existing) > MaxAbilities {
+		existing = existing[:MaxAbilities]
+	}
+	return existing
+}
+
+// Tracks a user's breakdown across reports, starting over whenever a new
+// encounter begins
+type EncounterAbilities struct {
+	CombatStart           time.Time
+	Breakdown             AbilityBreakdown
+}
+
+// Update merges a report for the encounter that started at combatStart
+func (e *EncounterAbilities) Update(combatStart time.Time, update *AbilityBreakdown) {
+	if !combatStart.Equal(e.CombatStart) {
+		e.CombatStart = combatStart
+		e.Breakdown = AbilityBreakdown{}
+	}
+	e.Breakdown.Merge(update)
+}
@@ -0,0 +1,173 @@
+package stats
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Hand-rolled encoding of the messages in stats.proto, which is small and
+// stable enough to not be worth generated code
+
+func marshalProtoList(users []UserStats) []byte {
+	b := make([]byte, 0, len(users)*64)
+	for i := range users {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendProto(nil, &users[i]))
+	}
+	return b
+}
+
+func unmarshalProtoList(b []byte) ([]UserStats, error) {
+	users := make([]UserStats, 0, 16)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if num == 1 && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			var s UserStats
+			if err := unmarshalProto(v, &s); err != nil {
+				return nil, err
+			}
+			users = append(users, s)
+			b = b[n:]
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return users, nil
+}
+
+func appendProto(b []byte, s *UserStats) []byte {
+	b = appendProtoVarint(b, 1, int64(s.RaidUserId))
+	if s.CharacterName != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, s.CharacterName)
+	}
+	b = appendProtoVarint(b, 3, s.DamageOut)
+	b = appendProtoVarint(b, 4, s.DamageIn)
+	b = appendProtoVarint(b, 5, s.HealOut)
+	b = appendProtoVarint(b, 6, s.EffectiveHealOut)
+	b = appendProtoVarint(b, 7, s.HealIn)
+	b = appendProtoVarint(b, 8, s.Threat)
+	b = appendProtoVarint(b, 9, int64(s.RaidEncounterId))
+	b = appendProtoVarint(b, 10, int64(s.RaidEncounterMode))
+	b = appendProtoVarint(b, 11, int64(s.RaidEncounterPlayers))
+	b = appendProtoVarint(b, 12, s.CombatTicks)
+	b = appendProtoVarint(b, 13, protoTime(s.CombatStart))
+	b = appendProtoVarint(b, 14, protoTime(s.CombatEnd))
+	b = appendProtoVarint(b, 15, protoTime(s.LastCombatUpdate))
+	if s.Role != "" {
+		b = protowire.AppendTag(b, 16, protowire.BytesType)
+		b = protowire.AppendString(b, s.Role)
+	}
+	return b
+}
+
+func unmarshalProto(b []byte, s *UserStats) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		// Strings
+		if (num == 2 || num == 16) && typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if num == 2 {
+				s.CharacterName = v
+			} else {
+				s.Role = v
+			}
+			b = b[n:]
+			continue
+		}
+
+		// Skip unknown fields
+		if typ != protowire.VarintType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		// Everything else is a varint
+		u, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		v := int64(u)
+		switch num {
+		case 1:
+			s.RaidUserId = int32(v)
+		case 3:
+			s.DamageOut = v
+		case 4:
+			s.DamageIn = v
+		case 5:
+			s.HealOut = v
+		case 6:
+			s.EffectiveHealOut = v
+		case 7:
+			s.HealIn = v
+		case 8:
+			s.Threat = v
+		case 9:
+			s.RaidEncounterId = int32(v)
+		case 10:
+			s.RaidEncounterMode = int32(v)
+		case 11:
+			s.RaidEncounterPlayers = int32(v)
+		case 12:
+			s.CombatTicks = v
+		case 13:
+			s.CombatStart = fromProtoTime(v)
+		case 14:
+			s.CombatEnd = fromProtoTime(v)
+		case 15:
+			s.LastCombatUpdate = fromProtoTime(v)
+		}
+	}
+	return nil
+}
+
+// Zero values are omitted, as in proto3
+func appendProtoVarint(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func protoTime(t RFC3339NanoTime) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromProtoTime(v int64) RFC3339NanoTime {
+	if v == 0 {
+		return RFC3339NanoTime{}
+	}
+	return RFC3339NanoTime{time.Unix(0, v).UTC()}
+}
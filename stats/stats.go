@@ -0,0 +1,60 @@
+// Package stats defines the per-user combat statistics synced between Parsec
+// clients and the server.
+package stats
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+type RFC3339NanoTime struct {
+	time.Time
+}
+
+type UserStats struct {
+	RaidUserId            int32
+	CharacterName         string
+	DamageOut             int64
+	DamageIn              int64
+	HealOut               int64
+	EffectiveHealOut      int64
+	HealIn                int64
+	Threat                int64
+	RaidEncounterId       int32
+	RaidEncounterMode     int32
+	RaidEncounterPlayers  int32
+	CombatTicks           int64
+	CombatStart           RFC3339NanoTime
+	CombatEnd             RFC3339NanoTime
+	LastCombatUpdate      RFC3339NanoTime // Server provided
+	Role                  string // tank, healer or dps; may be overridden by a group admin
+}
+
+// Serialize and deserialize time to reduce memory
+const RFC3339NanoJSON = `"`+time.RFC3339Nano+`"`
+func (t RFC3339NanoTime) MarshalJSON() ([]byte, error) {
+	return []byte(t.Format(RFC3339NanoJSON)), nil
+}
+func (t *RFC3339NanoTime) UnmarshalJSON(data []byte) error {
+	realTime, err := time.Parse(RFC3339NanoJSON, string(data[:]))
+	if err != nil {
+		return err
+	}
+	*t = RFC3339NanoTime{realTime}
+	return nil
+}
+
+// Totals are tracked in 64 bits, but old clients can only read 32-bit values,
+// so they're sent capped at the largest one rather than wrapping around
+type Counter int64
+
+func (c Counter) MarshalJSON() ([]byte, error) {
+	v := int64(c)
+	if v > math.MaxInt32 {
+		v = math.MaxInt32
+	} else if v < math.MinInt32 {
+		v = math.MinInt32
+	}
+	return strconv.AppendInt(nil, v, 10), nil
+}
@@ -0,0 +1,73 @@
+package stats
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+)
+
+// Counters saturate at 32 bits on the wire, for old clients
+func TestCounterMarshalJSON(t *testing.T) {
+	tests := []struct {
+		value int64
+		want  string
+	}{
+		{0, "0"},
+		{1, "1"},
+		{-1, "-1"},
+		{math.MaxInt32, "2147483647"},
+		{math.MaxInt32 + 1, "2147483647"},
+		{math.MaxInt64, "2147483647"},
+		{math.MinInt32, "-2147483648"},
+		{math.MinInt32 - 1, "-2147483648"},
+		{math.MinInt64, "-2147483648"},
+	}
+	for _, test := range tests {
+		got, err := json.Marshal(Counter(test.value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("Counter(%d) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+// Counters are read in full, and only capped when sent back out
+func TestCounterRoundTrip(t *testing.T) {
+	type user struct {
+		DamageOut Counter
+		Threat    Counter
+	}
+	tests := []struct {
+		value int64
+		want  string
+	}{
+		{123456, `{"DamageOut":123456,"Threat":123456}`},
+		{math.MaxInt64, `{"DamageOut":2147483647,"Threat":2147483647}`},
+		{-5, `{"DamageOut":-5,"Threat":-5}`},
+		{math.MinInt64, `{"DamageOut":-2147483648,"Threat":-2147483648}`},
+	}
+	for _, test := range tests {
+		value := strconv.FormatInt(test.value, 10)
+		var u user
+		err := json.Unmarshal([]byte(`{"DamageOut":`+value+`,"Threat":`+value+`}`), &u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(u.DamageOut) != test.value || int64(u.Threat) != test.value {
+			t.Errorf("%d read as %d, %d", test.value, u.DamageOut, u.Threat)
+		}
+		got, _ := json.Marshal(&u)
+		if string(got) != test.want {
+			t.Errorf("%d sent as %s, want %s", test.value, got, test.want)
+		}
+	}
+
+	// Past 64 bits can't be read at all
+	var u user
+	if err := json.Unmarshal([]byte(`{"DamageOut":9223372036854775808}`), &u); err == nil {
+		t.Errorf("read 2^63 as %d", u.DamageOut)
+	}
+}
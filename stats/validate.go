@@ -0,0 +1,216 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on what clients can report. Anything past these is either a bug or
+// a modified client, so it's rejected rather than shown to the group.
+const (
+	MaxCharacterNameLength  = 64
+	MaxRoleLength           = 16
+	MaxRaidEncounterPlayers = 24
+	MaxAbilities            = 1000 // Per list in a breakdown
+
+	// Highest plausible amount of damage, healing or threat per second for a
+	// single player, far above what anyone actually does
+	MaxRatePerSecond = 1000000
+
+	// How far ahead of the server a client's clock can be
+	MaxClockSkew = time.Hour
+)
+
+// A reported value that failed validation
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+func fieldError(field string, format string, args ...interface{}) *FieldError {
+	return &FieldError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// Validate checks that reported stats are well formed and plausible, returning
+// a *FieldError for the first field that isn't
+func (s *UserStats) Validate(now time.Time) error {
+	if s.RaidUserId < 0 {
+		return fieldError("RaidUserId", "must not be negative")
+	}
+	if err := validateName("CharacterName", s.CharacterName, MaxCharacterNameLength); err != nil {
+		return err
+	}
+	if err := validateName("Role", s.Role, MaxRoleLength); err != nil {
+		return err
+	}
+
+	totals := s.totals()
+	for _, t := range totals {
+		if t.value < 0 {
+			return fieldError(t.name, "must not be negative")
+		}
+	}
+	if s.EffectiveHealOut > s.HealOut {
+		return fieldError("EffectiveHealOut", "is more than HealOut")
+	}
+
+	if s.RaidEncounterId < 0 {
+		return fieldError("RaidEncounterId", "must not be negative")
+	}
+	if s.RaidEncounterMode < 0 {
+		return fieldError("RaidEncounterMode", "must not be negative")
+	}
+	if s.RaidEncounterPlayers < 0 || s.RaidEncounterPlayers > MaxRaidEncounterPlayers {
+		return fieldError("RaidEncounterPlayers", "must be between 0 and %d", MaxRaidEncounterPlayers)
+	}
+	if s.CombatTicks < 0 {
+		return fieldError("CombatTicks", "must not be negative")
+	}
+
+	latest := now.Add(MaxClockSkew)
+	if s.CombatStart.After(latest) {
+		return fieldError("CombatStart", "is in the future")
+	}
+	if s.CombatEnd.After(latest) {
+		return fieldError("CombatEnd", "is in the future")
+	}
+	if !s.CombatEnd.IsZero() && s.CombatEnd.Before(s.CombatStart.Time) {
+		return fieldError("CombatEnd", "is before CombatStart")
+	}
+
+	// Totals can't grow faster than any player could manage. Fights shorter
+	// than a second are treated as a second long.
+	seconds := s.Duration(now).Seconds()
+	if seconds < 1 {
+		seconds = 1
+	}
+	for _, t := range totals {
+		if float64(t.value)/seconds > MaxRatePerSecond {
+			return fieldError(t.name, "is implausibly high for a %.0f second fight", seconds)
+		}
+	}
+	return nil
+}
+
+// Validate checks the stats and any ability breakdown
+func (u *StatsUpdate) Validate(now time.Time) error {
+	err := u.UserStats.Validate(now)
+	if err != nil || u.Abilities == nil {
+		return err
+	}
+	lists := []struct {
+		name      string
+		abilities []AbilityStats
+	}{
+		{"Abilities.DamageOut", u.Abilities.DamageOut},
+		{"Abilities.HealOut", u.Abilities.HealOut},
+		{"Abilities.DamageIn", u.Abilities.DamageIn},
+	}
+	for _, list := range lists {
+		if len(list.abilities) > MaxAbilities {
+			return fieldError(list.name, "has more than %d abilities", MaxAbilities)
+		}
+		for i := range list.abilities {
+			a := &list.abilities[i]
+			field := fmt.Sprintf("%s[%d]", list.name, i)
+			if err := validateName(field+".AbilityName", a.AbilityName, MaxCharacterNameLength); err != nil {
+				return err
+			}
+			if a.Hits < 0 || a.Crits < 0 || a.Total < 0 || a.Max < 0 {
+				return fieldError(field, "must not have negative values")
+			}
+			if a.Crits > a.Hits {
+				return fieldError(field+".Crits", "is more than Hits")
+			}
+			if a.Max > a.Total {
+				return fieldError(field+".Max", "is more than Total")
+			}
+		}
+	}
+	return nil
+}
+
+// Duration returns how long the reported encounter has lasted, preferring the
+// client's own count of time in combat
+func (s *UserStats) Duration(now time.Time) time.Duration {
+	if s.CombatTicks > 0 {
+		return TicksDuration(s.CombatTicks)
+	}
+	if s.CombatStart.IsZero() {
+		return 0
+	}
+	end := s.CombatEnd.Time
+	if end.IsZero() {
+		end = now
+	}
+	return end.Sub(s.CombatStart.Time)
+}
+
+// TicksDuration converts the 100ns ticks clients count time in to a
+// duration, saturating rather than overflowing
+func TicksDuration(ticks int64) time.Duration {
+	if ticks > math.MaxInt64/100 {
+		return math.MaxInt64
+	} else if ticks < math.MinInt64/100 {
+		return math.MinInt64
+	}
+	return time.Duration(ticks * 100)
+}
+
+// Decreased returns the cumulative totals that went down between two reports
+// for the same encounter, which means the client reset its meters mid-fight.
+// Reports for different encounters never count as decreasing.
+func Decreased(previous *UserStats, current *UserStats) []string {
+	if previous.RaidEncounterId != current.RaidEncounterId || !previous.CombatStart.Equal(current.CombatStart.Time) || current.CombatStart.IsZero() {
+		return nil
+	}
+	var decreased []string
+	before := previous.totals()
+	for i, t := range current.totals() {
+		if t.value < before[i].value {
+			decreased = append(decreased, t.name)
+		}
+	}
+	if current.CombatTicks < previous.CombatTicks {
+		decreased = append(decreased, "CombatTicks")
+	}
+	return decreased
+}
+
+type total struct {
+	name  string
+	value int64
+}
+
+func (s *UserStats) totals() [6]total {
+	return [6]total{
+		{"DamageOut", s.DamageOut},
+		{"DamageIn", s.DamageIn},
+		{"HealOut", s.HealOut},
+		{"EffectiveHealOut", s.EffectiveHealOut},
+		{"HealIn", s.HealIn},
+		{"Threat", s.Threat},
+	}
+}
+
+func validateName(field string, value string, maxLength int) error {
+	if !utf8.ValidString(value) {
+		return fieldError(field, "is not valid UTF-8")
+	}
+	if utf8.RuneCountInString(value) > maxLength {
+		return fieldError(field, "must be at most %d characters", maxLength)
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return fieldError(field, "must not contain control characters")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package stats
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func validStats(now time.Time) UserStats {
+	return UserStats{
+		RaidUserId:           5,
+		CharacterName:        "Karmeld",
+		DamageOut:            2000000,
+		DamageIn:             100000,
+		HealOut:              300000,
+		EffectiveHealOut:     250000,
+		HealIn:               40000,
+		Threat:               900000,
+		RaidEncounterId:      12,
+		RaidEncounterMode:    3,
+		RaidEncounterPlayers: 8,
+		CombatTicks:          int64(2 * time.Minute / 100),
+		CombatStart:          RFC3339NanoTime{now.Add(-2 * time.Minute)},
+		CombatEnd:            RFC3339NanoTime{now},
+		Role:                 "dps",
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Date(2024, 3, 9, 20, 15, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		change func(s *UserStats)
+		field  string // Empty if valid
+	}{
+		{"valid", func(s *UserStats) {}, ""},
+		{"nothing reported", func(s *UserStats) { *s = UserStats{} }, ""},
+		{"still in combat", func(s *UserStats) { s.CombatEnd = RFC3339NanoTime{} }, ""},
+		{"no ticks", func(s *UserStats) { s.CombatTicks = 0 }, ""},
+
+		// Ids out of range
+		{"negative raid user", func(s *UserStats) { s.RaidUserId = -1 }, "RaidUserId"},
+		{"negative encounter", func(s *UserStats) { s.RaidEncounterId = -1 }, "RaidEncounterId"},
+		{"lowest encounter", func(s *UserStats) { s.RaidEncounterId = math.MinInt32 }, "RaidEncounterId"},
+		{"negative mode", func(s *UserStats) { s.RaidEncounterMode = -3 }, "RaidEncounterMode"},
+		{"negative players", func(s *UserStats) { s.RaidEncounterPlayers = -8 }, "RaidEncounterPlayers"},
+		{"too many players", func(s *UserStats) { s.RaidEncounterPlayers = MaxRaidEncounterPlayers + 1 }, "RaidEncounterPlayers"},
+		{"most players", func(s *UserStats) { s.RaidEncounterPlayers = MaxRaidEncounterPlayers }, ""},
+
+		// Negative counters
+		{"negative damage out", func(s *UserStats) { s.DamageOut = -1 }, "DamageOut"},
+		{"negative damage in", func(s *UserStats) { s.DamageIn = math.MinInt64 }, "DamageIn"},
+		{"negative heal out", func(s *UserStats) { s.HealOut, s.EffectiveHealOut = -10, -20 }, "HealOut"},
+		{"negative effective heal", func(s *UserStats) { s.EffectiveHealOut = -1 }, "EffectiveHealOut"},
+		{"negative heal in", func(s *UserStats) { s.HealIn = -1 }, "HealIn"},
+		{"negative threat", func(s *UserStats) { s.Threat = -1 }, "Threat"},
+		{"negative ticks", func(s *UserStats) { s.CombatTicks = -1 }, "CombatTicks"},
+		{"effective over total", func(s *UserStats) { s.EffectiveHealOut = s.HealOut + 1 }, "EffectiveHealOut"},
+
+		// Counters too big for the fight, including ones that would overflow
+		// if multiplied
+		{"implausible damage", func(s *UserStats) { s.DamageOut = 121 * MaxRatePerSecond }, "DamageOut"},
+		{"most damage", func(s *UserStats) { s.DamageOut = 120 * MaxRatePerSecond }, ""},
+		{"largest damage", func(s *UserStats) { s.DamageOut = math.MaxInt64 }, "DamageOut"},
+		{"largest threat", func(s *UserStats) { s.Threat = math.MaxInt64 }, "Threat"},
+		{"short fight", func(s *UserStats) { s.CombatTicks, s.DamageOut = 1, 2*MaxRatePerSecond }, "DamageOut"},
+		{"largest ticks", func(s *UserStats) { s.CombatTicks = math.MaxInt64 }, ""},
+		{"ticks past overflow", func(s *UserStats) { s.CombatTicks = math.MaxInt64/100 + 1 }, ""},
+
+		// Times
+		{"start in future", func(s *UserStats) { s.CombatStart = RFC3339NanoTime{now.Add(2 * MaxClockSkew)} }, "CombatStart"},
+		{"end in future", func(s *UserStats) { s.CombatEnd = RFC3339NanoTime{now.Add(2 * MaxClockSkew)} }, "CombatEnd"},
+		{"clock skew", func(s *UserStats) { s.CombatEnd = RFC3339NanoTime{now.Add(MaxClockSkew / 2)} }, ""},
+		{"end before start", func(s *UserStats) { s.CombatEnd = RFC3339NanoTime{now.Add(-time.Hour)} }, "CombatEnd"},
+
+		// Names
+		{"long name", func(s *UserStats) { s.CharacterName = strings.Repeat("a", MaxCharacterNameLength+1) }, "CharacterName"},
+		{"long unicode name", func(s *UserStats) { s.CharacterName = strings.Repeat("ë", MaxCharacterNameLength) }, ""},
+		{"invalid UTF-8", func(s *UserStats) { s.CharacterName = "Kar\xffmeld" }, "CharacterName"},
+		{"control character", func(s *UserStats) { s.CharacterName = "Kar\nmeld" }, "CharacterName"},
+		{"long role", func(s *UserStats) { s.Role = strings.Repeat("r", MaxRoleLength+1) }, "Role"},
+	}
+	for _, test := range tests {
+		s := validStats(now)
+		test.change(&s)
+		err := s.Validate(now)
+
+		var fieldErr *FieldError
+		if test.field == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+		} else if !errors.As(err, &fieldErr) {
+			t.Errorf("%s: got %v, want an error for %s", test.name, err, test.field)
+		} else if fieldErr.Field != test.field {
+			t.Errorf("%s: got an error for %s (%v), want %s", test.name, fieldErr.Field, err, test.field)
+		}
+	}
+}
+
+func TestValidateAbilities(t *testing.T) {
+	now := time.Date(2024, 3, 9, 20, 15, 0, 0, time.UTC)
+	tooMany := make([]AbilityStats, MaxAbilities+1)
+	tests := []struct {
+		name      string
+		abilities AbilityBreakdown
+		field     string
+	}{
+		{"valid", AbilityBreakdown{DamageOut: []AbilityStats{{AbilityId: 1, AbilityName: "Strike", Hits: 10, Crits: 2, Total: 1000, Max: 200}}}, ""},
+		{"too many", AbilityBreakdown{HealOut: tooMany}, "Abilities.HealOut"},
+		{"negative", AbilityBreakdown{DamageIn: []AbilityStats{{Total: -1}}}, "Abilities.DamageIn[0]"},
+		{"more crits than hits", AbilityBreakdown{DamageOut: []AbilityStats{{}, {Hits: 1, Crits: 2}}}, "Abilities.DamageOut[1].Crits"},
+		{"max over total", AbilityBreakdown{DamageOut: []AbilityStats{{Total: 10, Max: math.MaxInt64}}}, "Abilities.DamageOut[0].Max"},
+		{"bad name", AbilityBreakdown{DamageOut: []AbilityStats{{AbilityName: "\x00"}}}, "Abilities.DamageOut[0].AbilityName"},
+	}
+	for _, test := range tests {
+		abilities := test.abilities
+		update := StatsUpdate{UserStats: validStats(now), Abilities: &abilities}
+		err := update.Validate(now)
+
+		var fieldErr *FieldError
+		if test.field == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+		} else if !errors.As(err, &fieldErr) || fieldErr.Field != test.field {
+			t.Errorf("%s: got %v, want an error for %s", test.name, err, test.field)
+		}
+	}
+}
+
+// Times have to say which zone they're in, or the server can't tell when
+// they were
+func TestUnmarshalTimeOffset(t *testing.T) {
+	tests := []struct {
+		time  string
+		valid bool
+	}{
+		{"2024-03-09T20:15:04Z", true},
+		{"2024-03-09T20:15:04.123456789-05:00", true},
+		{"2024-03-09T20:15:04", false},
+		{"2024-03-09T20:15:04.123", false},
+		{"2024-03-09 20:15:04Z", false},
+	}
+	for _, test := range tests {
+		var update StatsUpdate
+		body := `{"CharacterName":"Karmeld","CombatStart":"` + test.time + `"}`
+		err := UnmarshalUpdate(JSON, []byte(body), &update)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", test.time, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: parsed as %v", test.time, update.CombatStart.Time)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	start := time.Date(2024, 3, 9, 20, 15, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		stats UserStats
+		want  time.Duration
+	}{
+		{"ticks", UserStats{CombatTicks: 15000000}, 1500 * time.Millisecond},
+		{"ticks over times", UserStats{CombatTicks: 10, CombatStart: RFC3339NanoTime{start}, CombatEnd: RFC3339NanoTime{start.Add(time.Minute)}}, time.Microsecond},
+		{"times", UserStats{CombatStart: RFC3339NanoTime{start}, CombatEnd: RFC3339NanoTime{start.Add(time.Minute)}}, time.Minute},
+		{"still in combat", UserStats{CombatStart: RFC3339NanoTime{start}}, 2 * time.Minute},
+		{"nothing", UserStats{}, 0},
+		{"largest ticks", UserStats{CombatTicks: math.MaxInt64}, math.MaxInt64},
+		{"ticks past overflow", UserStats{CombatTicks: math.MaxInt64/100 + 1}, math.MaxInt64},
+	}
+	for _, test := range tests {
+		if got := test.stats.Duration(start.Add(2 * time.Minute)); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTicksDuration(t *testing.T) {
+	tests := []struct {
+		ticks int64
+		want  time.Duration
+	}{
+		{0, 0},
+		{1, 100},
+		{-1, -100},
+		{math.MaxInt64 / 100, time.Duration(math.MaxInt64 / 100 * 100)},
+		{math.MaxInt64/100 + 1, math.MaxInt64},
+		{math.MaxInt64, math.MaxInt64},
+		{math.MinInt64, math.MinInt64},
+	}
+	for _, test := range tests {
+		if got := TicksDuration(test.ticks); got != test.want {
+			t.Errorf("TicksDuration(%d) = %d, want %d", test.ticks, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Wire formats for stats payloads, identified by their media type
+const (
+	JSON        = "application/json"
+	Protobuf    = "application/x-protobuf"
+	MessagePack = "application/x-msgpack"
+)
+
+var ErrUnsupportedFormat = errors.New("Unsupported stats format")
+
+// NegotiateFormat picks the wire format for a response from the request's
+// Accept header, preferring whichever supported format has the highest
+// quality value and falling back to JSON. Ties go to the first listed.
+func NegotiateFormat(accept string) string {
+	best := JSON
+	bestQ := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+		format := ParseFormat(mediaType)
+		if format == "" && (mediaType == "*/*" || mediaType == "application/*") {
+			format = JSON
+		}
+		if format != "" && q > bestQ {
+			best = format
+			bestQ = q
+		}
+	}
+	return best
+}
+
+// ParseFormat maps a media type to the wire format it names, returning an
+// empty string if it isn't one we support
+func ParseFormat(mediaType string) string {
+	switch strings.ToLower(mediaType) {
+	case JSON:
+		return JSON
+	case Protobuf, "application/protobuf", "application/vnd.google.protobuf":
+		return Protobuf
+	case MessagePack, "application/msgpack", "application/vnd.msgpack":
+		return MessagePack
+	}
+	return ""
+}
+
+// RequestFormat returns the wire format of a request body from its
+// Content-Type header. Older clients don't set a meaningful one, so anything
+// unrecognized is treated as JSON.
+func RequestFormat(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return JSON
+	}
+	format := ParseFormat(mediaType)
+	if format == "" {
+		return JSON
+	}
+	return format
+}
+
+// MarshalList encodes a list of user stats in the given format
+func MarshalList(format string, users []UserStats) ([]byte, error) {
+	switch format {
+	case JSON:
+		return json.Marshal(&users)
+	case Protobuf:
+		return marshalProtoList(users), nil
+	case MessagePack:
+		// Counters are 64-bit, but most fit in far fewer bytes
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.UseCompactInts(true)
+		err := enc.Encode(&users)
+		return buf.Bytes(), err
+	}
+	return nil, ErrUnsupportedFormat
+}
+
+// UnmarshalList decodes a list of user stats in the given format
+func UnmarshalList(format string, data []byte) ([]UserStats, error) {
+	var users []UserStats
+	var err error
+	switch format {
+	case JSON:
+		err = json.Unmarshal(data, &users)
+	case Protobuf:
+		users, err = unmarshalProtoList(data)
+	case MessagePack:
+		err = msgpack.Unmarshal(data, &users)
+	default:
+		err = ErrUnsupportedFormat
+	}
+	return users, err
+}
+
+// Unmarshal decodes a single user's stats in the given format
+func Unmarshal(format string, data []byte, s *UserStats) error {
+	switch format {
+	case JSON:
+		return json.Unmarshal(data, s)
+	case Protobuf:
+		return unmarshalProto(data, s)
+	case MessagePack:
+		return msgpack.Unmarshal(data, s)
+	}
+	return ErrUnsupportedFormat
+}
+
+// MessagePack encodes stats as arrays rather than maps so field names aren't
+// repeated for every user, and times using the native timestamp extension
+func (s *UserStats) EncodeMsgpack(enc *msgpack.Encoder) error {
+	return enc.Encode([]interface{}{
+		s.RaidUserId,
+		s.CharacterName,
+		s.DamageOut,
+		s.DamageIn,
+		s.HealOut,
+		s.EffectiveHealOut,
+		s.HealIn,
+		s.Threat,
+		s.RaidEncounterId,
+		s.RaidEncounterMode,
+		s.RaidEncounterPlayers,
+		s.CombatTicks,
+		s.CombatStart.Time,
+		s.CombatEnd.Time,
+		s.LastCombatUpdate.Time,
+		s.Role,
+	})
+}
+
+func (s *UserStats) DecodeMsgpack(dec *msgpack.Decoder) error {
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	fields := []interface{}{
+		&s.RaidUserId,
+		&s.CharacterName,
+		&s.DamageOut,
+		&s.DamageIn,
+		&s.HealOut,
+		&s.EffectiveHealOut,
+		&s.HealIn,
+		&s.Threat,
+		&s.RaidEncounterId,
+		&s.RaidEncounterMode,
+		&s.RaidEncounterPlayers,
+		&s.CombatTicks,
+		&s.CombatStart.Time,
+		&s.CombatEnd.Time,
+		&s.LastCombatUpdate.Time,
+		&s.Role,
+	}
+	for i := 0; i < n; i++ {
+		// Skip fields added by newer clients
+		if i >= len(fields) {
+			err = dec.Skip()
+		} else {
+			err = dec.Decode(fields[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
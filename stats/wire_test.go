@@ -0,0 +1,142 @@
+package stats
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", JSON},
+		{"text/html", JSON},
+		{"application/json", JSON},
+		{"application/x-protobuf", Protobuf},
+		{"application/vnd.msgpack", MessagePack},
+		{"application/x-protobuf, application/x-msgpack", Protobuf},
+		{"application/x-protobuf;q=0.5, application/x-msgpack", MessagePack},
+		{"application/json;q=0.1, application/x-msgpack;q=0.9", MessagePack},
+		{"application/x-msgpack;q=0.8, */*;q=0.9", JSON},
+		{"application/x-protobuf;q=0, application/x-msgpack;q=0", JSON},
+		{"application/x-protobuf;q=0, text/plain", JSON},
+		{"application/x-protobuf;q=bogus, application/x-msgpack;q=0.1", MessagePack},
+		{"application/x-msgpack;q=0.5, application/x-protobuf;q=0.5", MessagePack},
+	}
+	for _, test := range tests {
+		if got := NegotiateFormat(test.accept); got != test.want {
+			t.Errorf("NegotiateFormat(%q) = %q, want %q", test.accept, got, test.want)
+		}
+	}
+}
+
+func TestRequestFormat(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"", JSON},
+		{"application/json; charset=utf-8", JSON},
+		{"application/x-www-form-urlencoded", JSON},
+		{"not a media type", JSON},
+		{"application/x-protobuf", Protobuf},
+		{"application/msgpack", MessagePack},
+	}
+	for _, test := range tests {
+		if got := RequestFormat(test.contentType); got != test.want {
+			t.Errorf("RequestFormat(%q) = %q, want %q", test.contentType, got, test.want)
+		}
+	}
+}
+
+func roundTripStats() []UserStats {
+	start := time.Date(2024, 3, 9, 20, 15, 4, 123456789, time.UTC)
+	return []UserStats{
+		{
+			RaidUserId:           5,
+			CharacterName:        "Karmeld",
+			DamageOut:            2000,
+			DamageIn:             100,
+			HealOut:              300,
+			EffectiveHealOut:     250,
+			HealIn:               40,
+			Threat:               9000,
+			RaidEncounterId:      12,
+			RaidEncounterMode:    3,
+			RaidEncounterPlayers: 8,
+			CombatTicks:          1234567890,
+			CombatStart:          RFC3339NanoTime{start},
+			CombatEnd:            RFC3339NanoTime{start.Add(2 * time.Minute)},
+			LastCombatUpdate:     RFC3339NanoTime{start.Add(3 * time.Minute)},
+			Role:                 "dps",
+		},
+		{
+			// Counters past int32, and nothing else set
+			RaidUserId:    -1,
+			CharacterName: "Zoë Ünïcode",
+			DamageOut:     math.MaxInt64,
+			HealOut:       math.MaxInt32 + 1,
+			Threat:        -7,
+		},
+		{},
+	}
+}
+
+// Stats decoded from protobuf and MessagePack should match what JSON gives
+func TestRoundTrip(t *testing.T) {
+	users := roundTripStats()
+	jsonBody, err := MarshalList(JSON, users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := UnmarshalList(JSON, jsonBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(fromJSON)
+
+	for _, format := range []string{Protobuf, MessagePack} {
+		body, err := MarshalList(format, users)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		decoded, err := UnmarshalList(format, body)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		got, _ := json.Marshal(decoded)
+		if string(got) != string(want) {
+			t.Errorf("%s round trip:\n got %s\nwant %s", format, got, want)
+		}
+	}
+}
+
+// A single user's stats, as clients send them
+func TestUnmarshalSingle(t *testing.T) {
+	user := roundTripStats()[0]
+	want, _ := json.Marshal(&user)
+	msgpackBody, err := msgpack.Marshal(&user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := map[string][]byte{
+		JSON:        want,
+		Protobuf:    appendProto(nil, &user),
+		MessagePack: msgpackBody,
+	}
+	for format, body := range bodies {
+		var decoded UserStats
+		if err := Unmarshal(format, body, &decoded); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		got, _ := json.Marshal(&decoded)
+		if string(got) != string(want) {
+			t.Errorf("%s:\n got %s\nwant %s", format, got, want)
+		}
+	}
+}
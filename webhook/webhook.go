@@ -0,0 +1,662 @@
+// Package webhook notifies URLs registered by a raid group's admin when
+// things happen in the group, like members connecting or encounters ending.
+//
+// Each event is POSTed as a JSON Payload. Deliveries are signed with the
+// webhook's secret so receivers can check they came from this server: the
+// X-Parsec-Signature header is "sha256=" followed by the hex HMAC-SHA256 of
+// the X-Parsec-Timestamp header, a ".", and the request body. Receivers
+// should reject old timestamps to stop deliveries being replayed.
+//
+// Webhooks can only be delivered to public addresses, checked when connecting
+// so a name can't resolve to somewhere else later, unless AllowPrivate is set.
+//
+// Deliveries that fail with a network error, a 408, a 429 or a 5xx are
+// retried with exponential backoff, up to MaxAttempts times. Retries are
+// only kept in memory, so any still waiting when the server stops are lost.
+// Every delivery is logged, and the log is kept for a while so admins can
+// see why their endpoint isn't being notified.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Events
+const (
+	MemberConnected    = "member.connected"
+	MemberDisconnected = "member.disconnected"
+	EncounterStarted   = "encounter.started"
+	EncounterEnded     = "encounter.ended"
+	PersonalBest       = "personal_best"
+	GroupDeleted       = "group.deleted"
+
+	// Sent by Test, to every webhook regardless of its events
+	Ping = "ping"
+)
+
+// Delivery statuses
+const (
+	Pending   = "pending" // Waiting to be retried
+	Delivered = "delivered"
+	Failed    = "failed"
+)
+
+// Request headers
+const (
+	EventHeader     = "X-Parsec-Event"
+	DeliveryHeader  = "X-Parsec-Delivery"
+	TimestampHeader = "X-Parsec-Timestamp"
+	SignatureHeader = "X-Parsec-Signature"
+)
+
+const (
+	MaxWebhooks   = 5 // Per group
+	MaxAttempts   = 5
+	MaxDeliveries = 100 // Returned by Deliveries
+
+	// Wait before the first retry, doubled for each one after
+	DefaultBackoff = 10 * time.Second
+
+	requestTimeout = 10 * time.Second
+	queueSize      = 1024
+	workers        = 4
+
+	insertWebhook     = "INSERT INTO raid_group_webhooks (group_id, url, secret, events, datetime) VALUES (?, ?, ?, ?, ?)"
+	deleteWebhook     = "DELETE FROM raid_group_webhooks WHERE group_id=? AND id=?"
+	deleteWebhooks    = "DELETE FROM raid_group_webhooks WHERE group_id=?"
+	selectWebhooks    = "SELECT id, url, secret, events, datetime FROM raid_group_webhooks WHERE group_id=? ORDER BY id"
+	upsertDelivery    = "INSERT OR REPLACE INTO webhook_deliveries VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	selectDeliveries  = "SELECT id, webhook_id, event, status, attempts, response_code, error, created, updated FROM webhook_deliveries WHERE group_id=?1 AND (?2=0 OR webhook_id=?2) ORDER BY created DESC, rowid DESC LIMIT ?3"
+	pruneDeliveries   = "DELETE FROM webhook_deliveries WHERE created<? OR group_id NOT IN (SELECT id FROM raid_groups)"
+	pruneWebhooks     = "DELETE FROM raid_group_webhooks WHERE group_id NOT IN (SELECT id FROM raid_groups)"
+	maxResponseLength = 64 << 10
+)
+
+// Events webhooks can subscribe to
+var Events = []string{MemberConnected, MemberDisconnected, EncounterStarted, EncounterEnded, PersonalBest, GroupDeleted}
+
+var (
+	ErrInvalidURL   = errors.New("Webhook URL must be an absolute http or https URL")
+	ErrUnknownEvent = errors.New("Unknown webhook event")
+	ErrTooMany      = fmt.Errorf("Groups can have at most %d webhooks", MaxWebhooks)
+	ErrNotFound     = errors.New("Webhook not found")
+	ErrPrivate      = errors.New("Webhook address is not public")
+)
+
+// Ranges that aren't public besides the ones net.IP can tell: "this network",
+// carrier-grade NAT, IETF protocol assignments, benchmarking and reserved
+var nonPublicRanges = parseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4")
+
+type Webhook struct {
+	Id      int64
+	URL     string
+	Secret  string   `json:",omitempty"` // Only returned when registered
+	Events  []string // Empty for every event
+	Created string
+}
+
+// A logged delivery of an event to a webhook
+type Delivery struct {
+	Id           string
+	WebhookId    int64
+	Event        string
+	Status       string
+	Attempts     int
+	ResponseCode int    `json:",omitempty"`
+	Error        string `json:",omitempty"`
+	Created      string
+	Updated      string
+}
+
+// The body of every delivery
+type Payload struct {
+	Id    string // Same as the X-Parsec-Delivery header, and across retries
+	Event string
+	Group string
+	Time  time.Time
+	Data  interface{}
+}
+
+type Dispatcher struct {
+	// Wait before the first retry, doubled for each one after
+	Backoff time.Duration
+
+	// Whether webhooks can be delivered to loopback, private and link-local
+	// addresses, for receivers on the server's own network
+	AllowPrivate bool
+
+	client      *http.Client
+	events      chan *pendingEvent
+	queue       chan *job
+	insertStmt  *sql.Stmt
+	deleteStmt  *sql.Stmt
+	purgeStmt   *sql.Stmt
+	hooksStmt   *sql.Stmt
+	logStmt     *sql.Stmt
+	historyStmt *sql.Stmt
+	pruneStmts  []*sql.Stmt
+
+	// Webhooks by group, loaded as groups send events. The generation
+	// changes whenever any are forgotten, so a load that raced with a change
+	// isn't cached.
+	hooksLock       sync.Mutex
+	hooks           map[uint32][]Webhook
+	hooksGeneration uint64
+
+	// Events and deliveries queued or being attempted, for Flush
+	activeLock sync.Mutex
+	active     int
+	idle       *sync.Cond
+}
+
+// An event waiting for its group's webhooks to be looked up
+type pendingEvent struct {
+	groupId uint32
+	group   string
+	name    string
+	data    json.RawMessage
+	time    time.Time
+}
+
+// An event on its way to a single webhook
+type job struct {
+	id       string
+	groupId  uint32
+	hook     Webhook
+	event    string
+	body     []byte
+	created  string
+	attempts int
+}
+
+// NewDispatcher prepares the dispatcher's queries and starts delivering. The
+// tables are created by migrations.
+func NewDispatcher(db *sql.DB) (*Dispatcher, error) {
+	d := &Dispatcher{
+		Backoff: DefaultBackoff,
+		events:  make(chan *pendingEvent, queueSize),
+		queue:   make(chan *job, queueSize),
+		hooks:   map[uint32][]Webhook{},
+	}
+	dialer := &net.Dialer{Timeout: requestTimeout, Control: d.checkAddress}
+	d.client = &http.Client{
+		Timeout: requestTimeout,
+		// No proxy, as it would connect to addresses that haven't been checked
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: requestTimeout,
+			MaxIdleConns:        workers,
+			IdleConnTimeout:     time.Minute,
+		},
+		// Redirects would turn the POST into a GET, so they count as failures
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	d.idle = sync.NewCond(&d.activeLock)
+	queries := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&d.insertStmt, insertWebhook},
+		{&d.deleteStmt, deleteWebhook},
+		{&d.purgeStmt, deleteWebhooks},
+		{&d.hooksStmt, selectWebhooks},
+		{&d.logStmt, upsertDelivery},
+		{&d.historyStmt, selectDeliveries},
+	}
+	for _, q := range queries {
+		stmt, err := db.Prepare(q.query)
+		if err != nil {
+			return nil, err
+		}
+		*q.stmt = stmt
+	}
+	for _, query := range []string{pruneDeliveries, pruneWebhooks} {
+		stmt, err := db.Prepare(query)
+		if err != nil {
+			return nil, err
+		}
+		d.pruneStmts = append(d.pruneStmts, stmt)
+	}
+
+	go d.resolve()
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d, nil
+}
+
+// ParseEvents parses a comma separated list of events, where empty means
+// every event
+func ParseEvents(value string) ([]string, error) {
+	events := []string{}
+	for _, event := range strings.Split(value, ",") {
+		event = strings.TrimSpace(event)
+		if event == "" {
+			continue
+		}
+		if !contains(Events, event) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownEvent, event)
+		}
+		if !contains(events, event) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// Register adds a webhook to the group, returning it with its new secret. URLs
+// with addresses that aren't public are refused unless AllowPrivate is set.
+func (d *Dispatcher) Register(groupId uint32, rawURL string, events []string) (Webhook, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return Webhook{}, ErrInvalidURL
+	}
+	// Names are checked when delivering, as they can resolve differently later
+	if ip := net.ParseIP(parsed.Hostname()); ip != nil && !d.AllowPrivate && !Public(ip) {
+		return Webhook{}, ErrPrivate
+	}
+	hooks, err := d.webhooks(groupId)
+	if err != nil {
+		return Webhook{}, err
+	}
+	if len(hooks) >= MaxWebhooks {
+		return Webhook{}, ErrTooMany
+	}
+
+	hook := Webhook{URL: parsed.String(), Secret: randomHex(32), Events: events, Created: time.Now().Format(time.RFC3339)}
+	if hook.Events == nil {
+		hook.Events = []string{}
+	}
+	result, err := d.insertStmt.Exec(groupId, hook.URL, hook.Secret, strings.Join(hook.Events, ","), hook.Created)
+	if err != nil {
+		return Webhook{}, err
+	}
+	hook.Id, err = result.LastInsertId()
+	if err != nil {
+		return Webhook{}, err
+	}
+	d.forget(groupId)
+	return hook, nil
+}
+
+// List returns the group's webhooks, without their secrets
+func (d *Dispatcher) List(groupId uint32) ([]Webhook, error) {
+	hooks, err := d.webhooks(groupId)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Webhook, len(hooks))
+	for i, hook := range hooks {
+		hook.Secret = ""
+		list[i] = hook
+	}
+	return list, nil
+}
+
+// Delete removes a webhook, returning false if the group doesn't have it.
+// Retries already waiting are still sent.
+func (d *Dispatcher) Delete(groupId uint32, id int64) (bool, error) {
+	result, err := d.deleteStmt.Exec(groupId, id)
+	if err != nil {
+		return false, err
+	}
+	d.forget(groupId)
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// Send delivers an event to every webhook of the group subscribed to it. The
+// data is encoded right away and everything else happens in the background,
+// so callers can hold locks and change the data after. Sending GroupDeleted
+// also deletes the group's webhooks once they've been looked up.
+func (d *Dispatcher) Send(groupId uint32, group string, event string, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Error encoding webhook payload: %v", err)
+		return
+	}
+	d.begin()
+	select {
+	case d.events <- &pendingEvent{groupId: groupId, group: group, name: event, data: body, time: time.Now()}:
+	default:
+		log.Printf("Webhook queue full, dropping %s event for %s", event, group)
+		d.done()
+	}
+}
+
+// Test sends a Ping to one of the group's webhooks and waits for the
+// response. Failed tests aren't retried.
+func (d *Dispatcher) Test(groupId uint32, group string, id int64) (Delivery, error) {
+	hooks, err := d.webhooks(groupId)
+	if err != nil {
+		return Delivery{}, err
+	}
+	for _, hook := range hooks {
+		if hook.Id == id {
+			e := &pendingEvent{groupId: groupId, group: group, name: Ping, time: time.Now()}
+			return d.attempt(newJob(e, hook), false), nil
+		}
+	}
+	return Delivery{}, ErrNotFound
+}
+
+// Deliveries returns the group's most recent deliveries, newest first, for
+// every webhook if id is 0
+func (d *Dispatcher) Deliveries(groupId uint32, id int64) ([]Delivery, error) {
+	rows, err := d.historyStmt.Query(groupId, id, MaxDeliveries)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]Delivery, 0, 16)
+	for rows.Next() {
+		var dl Delivery
+		err = rows.Scan(&dl.Id, &dl.WebhookId, &dl.Event, &dl.Status, &dl.Attempts, &dl.ResponseCode, &dl.Error, &dl.Created, &dl.Updated)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, dl)
+	}
+	return deliveries, rows.Err()
+}
+
+// Prune deletes deliveries logged before the given time, along with the
+// webhooks and deliveries of groups that no longer exist. Returns how many
+// deliveries were deleted.
+func (d *Dispatcher) Prune(before time.Time) (int64, error) {
+	result, err := d.pruneStmts[0].Exec(before.Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+	_, err = d.pruneStmts[1].Exec()
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Sign returns the signature header for a delivery
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newJob(e *pendingEvent, hook Webhook) *job {
+	j := &job{id: randomHex(16), groupId: e.groupId, hook: hook, event: e.name, created: e.time.Format(time.RFC3339)}
+	j.body, _ = json.Marshal(&Payload{Id: j.id, Event: e.name, Group: e.group, Time: e.time.UTC(), Data: e.data})
+	return j
+}
+
+// Looks up the webhooks for each event sent, in order
+func (d *Dispatcher) resolve() {
+	for e := range d.events {
+		d.dispatch(e)
+		d.done()
+	}
+}
+
+func (d *Dispatcher) dispatch(e *pendingEvent) {
+	hooks, err := d.webhooks(e.groupId)
+	if err != nil {
+		log.Printf("Error loading webhooks: %v", err)
+		return
+	}
+	if e.name == GroupDeleted {
+		_, err = d.purgeStmt.Exec(e.groupId)
+		if err != nil {
+			log.Printf("Error deleting webhooks: %v", err)
+		}
+		d.forget(e.groupId)
+	}
+	for _, hook := range hooks {
+		if len(hook.Events) > 0 && !contains(hook.Events, e.name) {
+			continue
+		}
+		d.enqueue(newJob(e, hook))
+	}
+}
+
+// Flush waits until every event sent has been queued for its webhooks and
+// every queued delivery has been attempted. Retries that haven't been queued
+// again yet aren't waited for.
+func (d *Dispatcher) Flush() {
+	d.activeLock.Lock()
+	for d.active > 0 {
+		d.idle.Wait()
+	}
+	d.activeLock.Unlock()
+}
+
+func (d *Dispatcher) enqueue(j *job) {
+	d.begin()
+	select {
+	case d.queue <- j:
+	default:
+		log.Printf("Webhook queue full, dropping %s delivery to %s", j.event, j.hook.URL)
+		d.record(j, Failed, 0, "Delivery queue full")
+		d.done()
+	}
+}
+
+func (d *Dispatcher) work() {
+	for j := range d.queue {
+		d.attempt(j, true)
+		d.done()
+	}
+}
+
+func (d *Dispatcher) begin() {
+	d.activeLock.Lock()
+	d.active++
+	d.activeLock.Unlock()
+}
+
+func (d *Dispatcher) done() {
+	d.activeLock.Lock()
+	d.active--
+	if d.active == 0 {
+		d.idle.Broadcast()
+	}
+	d.activeLock.Unlock()
+}
+
+// Makes one attempt at a delivery, scheduling the next if it can be retried
+func (d *Dispatcher) attempt(j *job, retry bool) Delivery {
+	j.attempts++
+	code, err := d.post(j)
+	status := Delivered
+	message := ""
+	if err != nil {
+		message = err.Error()
+		status = Failed
+		if retry && j.attempts < MaxAttempts && retryable(code) {
+			status = Pending
+			wait := d.Backoff << uint(j.attempts-1)
+			time.AfterFunc(wait, func() { d.enqueue(j) })
+		}
+	}
+	return d.record(j, status, code, message)
+}
+
+func (d *Dispatcher) post(j *job) (int, error) {
+	req, err := http.NewRequest("POST", j.hook.URL, bytes.NewReader(j.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Parsec-Webhook")
+	req.Header.Set(EventHeader, j.event)
+	req.Header.Set(DeliveryHeader, j.id)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(j.hook.Secret, timestamp, j.body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, maxResponseLength))
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("Unexpected response: %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// Network errors and responses saying to try again later are retried
+func retryable(code int) bool {
+	return code == 0 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
+
+func (d *Dispatcher) record(j *job, status string, code int, message string) Delivery {
+	dl := Delivery{
+		Id:           j.id,
+		WebhookId:    j.hook.Id,
+		Event:        j.event,
+		Status:       status,
+		Attempts:     j.attempts,
+		ResponseCode: code,
+		Error:        message,
+		Created:      j.created,
+		Updated:      time.Now().Format(time.RFC3339),
+	}
+	_, err := d.logStmt.Exec(dl.Id, dl.WebhookId, j.groupId, dl.Event, dl.Status, dl.Attempts, dl.ResponseCode, dl.Error, dl.Created, dl.Updated)
+	if err != nil {
+		log.Printf("Error logging webhook delivery: %v", err)
+	}
+	return dl
+}
+
+// Returns the group's webhooks, loading them if they aren't cached
+func (d *Dispatcher) webhooks(groupId uint32) ([]Webhook, error) {
+	d.hooksLock.Lock()
+	hooks, ok := d.hooks[groupId]
+	generation := d.hooksGeneration
+	d.hooksLock.Unlock()
+	if ok {
+		return hooks, nil
+	}
+
+	rows, err := d.hooksStmt.Query(groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks = []Webhook{}
+	for rows.Next() {
+		var hook Webhook
+		var events string
+		err = rows.Scan(&hook.Id, &hook.URL, &hook.Secret, &events, &hook.Created)
+		if err != nil {
+			return nil, err
+		}
+		hook.Events, _ = ParseEvents(events)
+		hooks = append(hooks, hook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	d.hooksLock.Lock()
+	if d.hooksGeneration == generation {
+		d.hooks[groupId] = hooks
+	}
+	d.hooksLock.Unlock()
+	return hooks, nil
+}
+
+func (d *Dispatcher) forget(groupId uint32) {
+	d.hooksLock.Lock()
+	delete(d.hooks, groupId)
+	d.hooksGeneration++
+	d.hooksLock.Unlock()
+}
+
+// Refuses connections to addresses that aren't public, unless allowed. Runs
+// after the host has been resolved, for every address tried.
+func (d *Dispatcher) checkAddress(network string, address string, _ syscall.RawConn) error {
+	if d.AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !Public(ip) {
+		return ErrPrivate
+	}
+	return nil
+}
+
+// Public returns whether an address is on the public internet, rather than
+// loopback, private, link-local, multicast or otherwise reserved
+func Public(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if ip4.Equal(net.IPv4bcast) {
+			return false
+		}
+		for _, block := range nonPublicRanges {
+			if block.Contains(ip4) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	blocks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		blocks[i] = block
+	}
+	return blocks
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
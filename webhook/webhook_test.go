@@ -0,0 +1,364 @@
+package webhook
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/warhammerkid/parsec-go/migrations"
+)
+
+const testGroup = 1
+
+func newTestDispatcher(t *testing.T) *Dispatcher {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err = migrations.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO raid_groups (id, name, name_key) VALUES (?, 'Test', 'test')", testGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDispatcher(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Backoff = 10 * time.Millisecond
+	d.AllowPrivate = true // httptest servers listen on loopback
+	return d
+}
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// A webhook receiver that answers with each of the given statuses in turn,
+// then 200
+type receiver struct {
+	*httptest.Server
+	lock     sync.Mutex
+	statuses []int
+	requests []request
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	rec := &receiver{statuses: statuses}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.lock.Lock()
+		rec.requests = append(rec.requests, request{r.Header, body})
+		status := 200
+		if len(rec.statuses) > 0 {
+			status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+		}
+		rec.lock.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func (rec *receiver) received() []request {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return append([]request{}, rec.requests...)
+}
+
+func register(t *testing.T, d *Dispatcher, url string, events ...string) Webhook {
+	hook, err := d.Register(testGroup, url, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+// Waits for the latest delivery to stop being retried
+func lastDelivery(t *testing.T, d *Dispatcher) Delivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.Flush()
+		deliveries, err := d.Deliveries(testGroup, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) > 0 && deliveries[0].Status != Pending {
+			return deliveries[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery still pending: %+v", deliveries)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	d := newTestDispatcher(t)
+	rec := newReceiver(t)
+	hook := register(t, d, rec.URL+"/hook")
+	d.Send(testGroup, "Test", MemberConnected, map[string]string{"CharacterName": "Karmeld"})
+	d.Flush()
+
+	requests := rec.received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	req := requests[0]
+	timestamp := req.header.Get(TimestampHeader)
+	if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+		t.Errorf("bad timestamp %q", timestamp)
+	}
+	if got, want := req.header.Get(SignatureHeader), Sign(hook.Secret, timestamp, req.body); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if Sign("wrong", timestamp, req.body) == req.header.Get(SignatureHeader) {
+		t.Error("signature doesn't depend on the secret")
+	}
+	if req.header.Get(EventHeader) != MemberConnected {
+		t.Errorf("event header %q", req.header.Get(EventHeader))
+	}
+
+	var payload struct {
+		Id    string
+		Event string
+		Group string
+		Data  map[string]string
+	}
+	if err := json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Id != req.header.Get(DeliveryHeader) || payload.Event != MemberConnected || payload.Group != "Test" || payload.Data["CharacterName"] != "Karmeld" {
+		t.Errorf("unexpected payload %s", req.body)
+	}
+}
+
+func TestSign(t *testing.T) {
+	// HMAC-SHA256 of "1700000000.{}" with the key "secret"
+	want := "sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+	if got := Sign("secret", "1700000000", []byte("{}")); got != want {
+		t.Errorf("Sign = %q, want %q", got, want)
+	}
+	if Sign("secret", "1700000001", []byte("{}")) == want {
+		t.Error("signature doesn't depend on the timestamp")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	d := newTestDispatcher(t)
+	rec := newReceiver(t, 500, 429)
+	hook := register(t, d, rec.URL)
+	d.Send(testGroup, "Test", EncounterEnded, nil)
+
+	delivery := lastDelivery(t, d)
+	if delivery.Status != Delivered || delivery.Attempts != 3 || delivery.ResponseCode != 200 || delivery.WebhookId != hook.Id {
+		t.Errorf("got %+v", delivery)
+	}
+	requests := rec.received()
+	if len(requests) != 3 {
+		t.Fatalf("got %d requests, want 3", len(requests))
+	}
+	for _, req := range requests {
+		if req.header.Get(DeliveryHeader) != delivery.Id {
+			t.Errorf("retry sent as delivery %q, want %q", req.header.Get(DeliveryHeader), delivery.Id)
+		}
+	}
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	d := newTestDispatcher(t)
+	statuses := make([]int, MaxAttempts+1)
+	for i := range statuses {
+		statuses[i] = 503
+	}
+	rec := newReceiver(t, statuses...)
+	register(t, d, rec.URL)
+	d.Send(testGroup, "Test", EncounterEnded, nil)
+
+	delivery := lastDelivery(t, d)
+	if delivery.Status != Failed || delivery.Attempts != MaxAttempts || delivery.ResponseCode != 503 {
+		t.Errorf("got %+v", delivery)
+	}
+}
+
+// Client errors mean retrying won't help
+func TestNoRetry(t *testing.T) {
+	d := newTestDispatcher(t)
+	rec := newReceiver(t, 400)
+	register(t, d, rec.URL)
+	d.Send(testGroup, "Test", EncounterEnded, nil)
+
+	delivery := lastDelivery(t, d)
+	if delivery.Status != Failed || delivery.Attempts != 1 || delivery.ResponseCode != 400 || delivery.Error == "" {
+		t.Errorf("got %+v", delivery)
+	}
+	if len(rec.received()) != 1 {
+		t.Errorf("got %d requests, want 1", len(rec.received()))
+	}
+}
+
+func TestDeliveryLog(t *testing.T) {
+	d := newTestDispatcher(t)
+	rec := newReceiver(t)
+	first := register(t, d, rec.URL, EncounterEnded)
+	second := register(t, d, rec.URL+"/all")
+	d.Send(testGroup, "Test", MemberConnected, nil)
+	d.Send(testGroup, "Test", EncounterEnded, nil)
+	d.Flush()
+
+	// Only the webhook for every event gets MemberConnected
+	all, err := d.Deliveries(testGroup, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("got %d deliveries, want 3", len(all))
+	}
+	for _, delivery := range all {
+		if delivery.Status != Delivered || delivery.Attempts != 1 || delivery.Created == "" || delivery.Updated == "" {
+			t.Errorf("got %+v", delivery)
+		}
+	}
+	firsts, _ := d.Deliveries(testGroup, first.Id)
+	if len(firsts) != 1 || firsts[0].Event != EncounterEnded {
+		t.Errorf("got %+v for the first webhook", firsts)
+	}
+	seconds, _ := d.Deliveries(testGroup, second.Id)
+	if len(seconds) != 2 {
+		t.Errorf("got %+v for the second webhook", seconds)
+	}
+
+	// Other groups can't see them, and pruning forgets them
+	others, _ := d.Deliveries(testGroup+1, 0)
+	if len(others) != 0 {
+		t.Errorf("got %+v for another group", others)
+	}
+	pruned, err := d.Prune(time.Now().Add(time.Hour))
+	if err != nil || pruned != 3 {
+		t.Errorf("pruned %d, %v", pruned, err)
+	}
+}
+
+func TestTest(t *testing.T) {
+	d := newTestDispatcher(t)
+	rec := newReceiver(t, 500)
+	hook := register(t, d, rec.URL, EncounterEnded)
+
+	// Tests aren't retried
+	delivery, err := d.Test(testGroup, "Test", hook.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != Failed || delivery.Event != Ping || delivery.ResponseCode != 500 {
+		t.Errorf("got %+v", delivery)
+	}
+	if _, err = d.Test(testGroup, "Test", hook.Id+1); err != ErrNotFound {
+		t.Errorf("testing a missing webhook: %v", err)
+	}
+}
+
+func TestGroupDeleted(t *testing.T) {
+	d := newTestDispatcher(t)
+	rec := newReceiver(t)
+	register(t, d, rec.URL, GroupDeleted)
+	d.Send(testGroup, "Test", GroupDeleted, nil)
+	d.Flush()
+
+	if len(rec.received()) != 1 {
+		t.Errorf("got %d requests, want 1", len(rec.received()))
+	}
+	hooks, err := d.List(testGroup)
+	if err != nil || len(hooks) != 0 {
+		t.Errorf("webhooks left after delete: %+v, %v", hooks, err)
+	}
+}
+
+func TestPrivateAddresses(t *testing.T) {
+	d := newTestDispatcher(t)
+	d.AllowPrivate = false
+	for _, url := range []string{"http://127.0.0.1/", "http://[::1]:8080/", "http://169.254.169.254/latest", "https://10.1.2.3/", "http://[::ffff:192.168.0.1]/"} {
+		if _, err := d.Register(testGroup, url, nil); err != ErrPrivate {
+			t.Errorf("registering %s: %v", url, err)
+		}
+	}
+
+	// Names are only resolved when delivering
+	rec := newReceiver(t)
+	_, port, _ := net.SplitHostPort(rec.Listener.Addr().String())
+	hook := register(t, d, "http://localhost:"+port)
+	delivery, err := d.Test(testGroup, "Test", hook.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != Failed || !strings.Contains(delivery.Error, ErrPrivate.Error()) {
+		t.Errorf("got %+v", delivery)
+	}
+	if len(rec.received()) != 0 {
+		t.Errorf("private address was sent %d requests", len(rec.received()))
+	}
+
+	// Unless the operator allows them
+	d.AllowPrivate = true
+	delivery, _ = d.Test(testGroup, "Test", hook.Id)
+	if delivery.Status != Delivered {
+		t.Errorf("got %+v", delivery)
+	}
+}
+
+func TestPublic(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:8.8.8.8", true},
+	}
+	for _, test := range tests {
+		if got := Public(net.ParseIP(test.ip)); got != test.public {
+			t.Errorf("Public(%s) = %v, want %v", test.ip, got, test.public)
+		}
+	}
+}
+
+func TestParseEvents(t *testing.T) {
+	events, err := ParseEvents(" encounter.ended, member.connected,encounter.ended,")
+	if err != nil || strings.Join(events, ",") != "encounter.ended,member.connected" {
+		t.Errorf("got %v, %v", events, err)
+	}
+	if events, err = ParseEvents(""); err != nil || len(events) != 0 {
+		t.Errorf("got %v, %v for every event", events, err)
+	}
+	if _, err = ParseEvents("member.connected,bogus"); err == nil {
+		t.Error("unknown event accepted")
+	}
+}